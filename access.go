@@ -0,0 +1,173 @@
+package merkle
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"sort"
+	"time"
+)
+
+// The last time each tree was used is kept in the accessBkt. Access times are
+// recorded in memory and saved in batches so that reading a tree does not
+// write to the MetaStore. A batch is saved in the background every
+// accessFlushInterval, or sooner once accessFlushSize trees have been used.
+var accessBkt = []byte("a")
+
+const accessFlushInterval = time.Minute
+const accessFlushSize = 1024
+
+// touch records that a tree was used.
+func (f *Forest) touch(d *crypto.Digest) {
+	if f.readOnly {
+		return
+	}
+	f.accessMux.Lock()
+	f.accessed[*d] = f.clock()
+	full := len(f.accessed) >= accessFlushSize
+	f.accessMux.Unlock()
+	if full && f.flushNow != nil {
+		select {
+		case f.flushNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Accessed returns the last time the tree was created, read or had a leaf
+// added. It is zero if that is not known.
+func (t *Tree) Accessed() time.Time {
+	f := t.f
+	f.accessMux.Lock()
+	a, ok := f.accessed[*t.dig]
+	f.accessMux.Unlock()
+	if !ok {
+		f.meta.View(func(tx MetaTx) error {
+			a = f.getAccessTx(tx, f.sealDigest(t.dig))
+			return nil
+		})
+	}
+	return a
+}
+
+func (f *Forest) getAccessTx(tx MetaTx, key []byte) time.Time {
+	bkt := tx.Bucket(accessBkt)
+	if bkt == nil {
+		return time.Time{}
+	}
+	v, err := f.open(bkt.Get(key))
+	if err != nil || len(v) != 8 {
+		return time.Time{}
+	}
+	return unmarshalTime(v)
+}
+
+// flushAccess saves the access times recorded since the last flush. Access
+// times for trees that have been removed are dropped.
+func (f *Forest) flushAccess() error {
+	if f.writable() != nil {
+		return nil
+	}
+	f.accessMux.Lock()
+	pending := f.accessed
+	f.accessed = make(map[crypto.Digest]time.Time)
+	f.accessMux.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	err := f.meta.Update(func(tx MetaTx) error {
+		tb, ab := tx.Bucket(treeBkt), tx.Bucket(accessBkt)
+		for d, a := range pending {
+			d := d
+			key := f.sealDigest(&d)
+			if tb.Get(key) == nil {
+				continue
+			}
+			v := make([]byte, 8)
+			marshalTime(a, v)
+			if err := ab.Put(key, f.key().Seal(v, nil)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// keep them for the next flush, unless they were touched again
+		f.accessMux.Lock()
+		for d, a := range pending {
+			if _, ok := f.accessed[d]; !ok {
+				f.accessed[d] = a
+			}
+		}
+		f.accessMux.Unlock()
+	}
+	return err
+}
+
+// leafUsage is the number of bytes used by the leaves. It is approximate, every
+// leaf is counted as a full block.
+func (f *Forest) leafUsage(tx MetaTx) int64 {
+	return f.getStatsTx(tx)[statLeaves] * int64(f.blockSize+overhead)
+}
+
+// Evict removes the least recently used trees until the leaves use no more
+// than the DiskBudget and returns how many trees were removed. Pinned trees
+// and leaves shared with a tree that is kept are not removed. If there is no
+// DiskBudget, it does nothing. Finding the least recently used trees means
+// reading the access time of every tree, so once Evict has to remove trees it
+// goes on until the leaves use no more than 90% of the DiskBudget, so it isn't
+// needed again right away.
+func (f *Forest) Evict() (int, error) {
+	if err := f.writable(); err != nil {
+		return 0, err
+	}
+	if f.budget <= 0 {
+		return 0, nil
+	}
+	if err := f.flushAccess(); err != nil {
+		return 0, err
+	}
+	f.treeMux.Lock()
+	defer f.treeMux.Unlock()
+
+	var n int
+	var dead []*crypto.Digest
+	err := f.meta.Update(func(tx MetaTx) error {
+		n, dead = 0, dead[:0]
+		usage := f.leafUsage(tx)
+		if usage <= f.budget {
+			return nil
+		}
+		type entry struct {
+			dig      *crypto.Digest
+			accessed time.Time
+		}
+		var trees []entry
+		for _, d := range f.treeDigests(tx) {
+			if f.getPinTx(tx, d) == 0 {
+				trees = append(trees, entry{
+					dig:      d,
+					accessed: f.getAccessTx(tx, f.sealDigest(d)),
+				})
+			}
+		}
+		sort.Slice(trees, func(i, j int) bool {
+			return trees[i].accessed.Before(trees[j].accessed)
+		})
+		target := f.budget - f.budget/10
+		for _, t := range trees {
+			if usage <= target {
+				break
+			}
+			before := len(dead)
+			if err := f.deleteTreeTx(tx, t.dig, &dead); err != nil {
+				return err
+			}
+			usage -= int64(len(dead)-before) * int64(f.blockSize+overhead)
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, f.removeLeaves(dead)
+}
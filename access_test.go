@@ -0,0 +1,89 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestEvict(t *testing.T) {
+	clock := &testClock{now: time.Unix(1000000, 0)}
+	leafCost := int64(BlockSize + overhead)
+	f, err := newForest(crypto.RandomSymmetric(), newMemMeta(), newMemStore(), &Options{
+		Clock:      clock.Now,
+		DiskBudget: leafCost * 5,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	store := f.leaves.(*memStore)
+
+	// each tree has 2 leaves
+	var trees []*Tree
+	var data [][]byte
+	for i := 0; i < 3; i++ {
+		clock.Add(time.Minute)
+		d := make([]byte, BlockSize+10)
+		rand.Read(d)
+		tr, err := f.BuildTree(bytes.NewReader(d))
+		if !assert.NoError(t, err) {
+			return
+		}
+		trees = append(trees, tr)
+		data = append(data, d)
+	}
+	assert.Equal(t, 6, len(store.leaves))
+
+	clock.Add(time.Minute)
+	_, err = trees[0].ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, clock.Now(), trees[0].Accessed())
+	assert.NoError(t, f.flushAccess())
+	assert.Equal(t, clock.Now(), trees[0].Accessed())
+	assert.True(t, trees[1].Accessed().Before(trees[2].Accessed()))
+
+	// trees[1] is the least recently used
+	n, err := f.Evict()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 4, len(store.leaves))
+	assert.Nil(t, f.GetTree(trees[1].Digest()))
+	for _, i := range []int{0, 2} {
+		out, err := f.GetTree(trees[i].Digest()).ReadAll()
+		assert.NoError(t, err)
+		assert.Equal(t, data[i], out)
+	}
+	assertRefsConsistent(t, f)
+	assert.Equal(t, 2, bucketLen(f, accessBkt))
+
+	// within budget, nothing to do
+	n, err = f.Evict()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestAccessFlushSize(t *testing.T) {
+	f := OpenMemory(crypto.RandomSymmetric())
+	defer f.Close()
+	tr, err := f.BuildTree(bytes.NewReader([]byte("access")))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 0, bucketLen(f, accessBkt))
+	f.touch(tr.Digest())
+	for i := 1; i < accessFlushSize; i++ {
+		var d crypto.Digest
+		rand.Read(d[:])
+		f.touch(&d)
+	}
+
+	// the access time is saved in the background without Close or Evict
+	deadline := time.Now().Add(5 * time.Second)
+	for bucketLen(f, accessBkt) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, bucketLen(f, accessBkt))
+}
@@ -2,129 +2,256 @@ package merkle
 
 import (
 	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
 	"io"
-	"sync"
 )
 
-var blockPool = &sync.Pool{
-	New: func() interface{} {
-		return make([]byte, BlockSize)
-	},
-}
-
 // BuildTree takes a reader and saves the data read from it to a Merkle tree in
 // the Forest.
 func (f *Forest) BuildTree(r io.Reader) (*Tree, error) {
-	buf := blockPool.Get().([]byte)
+	return f.BuildTreeWithOptions(r, nil)
+}
+
+// BuildTreeWithOptions is BuildTree with options for the tree. If the tree is
+// already in the Forest, it keeps its namespace and the later of the two expiry
+// times, its meta data is only replaced if opts has Meta. The quotas are
+// checked before each new leaf is written, if one would be exceeded
+// ErrQuotaExceeded is returned and the leaves already written are left for GC.
+func (f *Forest) BuildTreeWithOptions(r io.Reader, opts *TreeOptions) (*Tree, error) {
+	if err := f.writable(); err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &TreeOptions{}
+	}
+	if opts.Meta != nil {
+		if err := opts.Meta.validate(); err != nil {
+			return nil, err
+		}
+	}
+	f.treeMux.RLock()
+	defer f.treeMux.RUnlock()
+	avail, limited := f.available(opts.Namespace)
+	buf := f.blocks.Get().([]byte)
 	var err error
 	var ls []*crypto.Digest
 	var lbl uint16
 	for err == nil {
 		cur, l := 0, 0
-		for err == nil && cur < BlockSize {
+		for err == nil && cur < f.blockSize {
 			l, err = r.Read(buf[cur:])
 			cur += l
 		}
-		d, _ := f.writeLeaf(buf, cur)
+		// the quota is checked before the leaf is written, a leaf that is
+		// already saved uses no more space so a tree that is already in the
+		// Forest can be built again
+		if limited && int64(len(ls))*int64(f.blockSize)+int64(cur) > avail && !f.hasLeaf(crypto.GetDigest(buf[:cur])) {
+			f.blocks.Put(buf)
+			return nil, ErrQuotaExceeded
+		}
+		var d *crypto.Digest
+		var wErr error
+		if err != nil && len(ls) == 0 && cur <= InlineSize {
+			d, wErr = f.writeInline(buf, cur)
+		} else {
+			d, wErr = f.writeLeaf(buf, cur)
+		}
+		if wErr != nil {
+			f.blocks.Put(buf)
+			return nil, wErr
+		}
 		lbl = uint16(cur)
 		ls = append(ls, d)
 	}
-	blockPool.Put(buf)
+	f.blocks.Put(buf)
 	if err.Error() == "EOF" {
 		err = nil
 	} else {
 		return nil, err
 	}
-	d, _ := recursiveBuild(f, ls)
+	if err = f.syncLeaves(); err != nil {
+		return nil, err
+	}
 	t := &Tree{
-		dig:          d,
 		leaves:       uint32(len(ls)),
 		lastBlockLen: lbl,
 		f:            f,
 		complete:     true,
+		expires:      opts.Expires,
+		namespace:    opts.Namespace,
 	}
-	f.writeTree(t)
-	return t, err
+	// all the branches and the tree are saved in a single transaction
+	err = f.meta.Update(func(tx MetaTx) error {
+		var err error
+		if t.dig, _, err = recursiveBuild(f, tx, ls); err != nil {
+			return err
+		}
+		old := f.getTreeTx(tx, t.dig)
+		if old != nil {
+			t.expires = laterExpiry(old.expires, t.expires)
+			t.namespace = old.namespace
+			t.meta = old.meta
+		}
+		if opts.Meta != nil {
+			var oldMeta *TreeMeta
+			if old != nil {
+				oldMeta = old.meta
+			}
+			t.meta = f.stampMeta(opts.Meta, oldMeta)
+		}
+		return f.writeTreeTx(tx, t)
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.touch(t.dig)
+	return t, nil
 }
 
-func recursiveBuild(f *Forest, leaves []*crypto.Digest) (*crypto.Digest, bool) {
+func recursiveBuild(f *Forest, tx MetaTx, leaves []*crypto.Digest) (*crypto.Digest, bool, error) {
 	l := len(leaves)
 	if l == 1 {
-		return leaves[0], true
+		return leaves[0], true, nil
 	}
 	ll := (l / 2)
 	var p byte
-	lb, isLeaf := recursiveBuild(f, leaves[:ll])
+	lb, isLeaf, err := recursiveBuild(f, tx, leaves[:ll])
+	if err != nil {
+		return nil, false, err
+	}
 	if isLeaf {
 		p |= lLeafMask
 	}
-	rb, isLeaf := recursiveBuild(f, leaves[ll:])
+	rb, isLeaf, err := recursiveBuild(f, tx, leaves[ll:])
+	if err != nil {
+		return nil, false, err
+	}
 	if isLeaf {
 		p |= rLeafMask
 	}
 	br := newBranch(lb, rb, p)
-	f.writeBranch(br)
-	return br.dig, false
+	if old := f.readBranchTx(tx, br.dig); old != nil {
+		if err = f.markLeaves(tx, old, p); err != nil {
+			return nil, false, err
+		}
+		br = old
+	} else if err = f.refChildren(tx, br); err != nil {
+		return nil, false, err
+	}
+	return br.dig, false, f.writeBranchTx(tx, br)
 }
 
-// AddLeaf will add a validated leaf to a Sapling.
-func (t *Tree) AddLeaf(vc ValidationChain, leaf []byte, lIdx int) {
-	if lIdx >= int(t.leaves) {
-		return
+// ErrBadLeaf is returned by AddLeaf if the leaf does not belong to the Tree.
+const ErrBadLeaf = errors.String("Leaf does not belong to Tree")
+
+// AddLeaf will add a validated leaf to a Sapling. The branches and the tree are
+// saved in a single transaction, if it fails the Tree is left as it was. Adding
+// a leaf that is already in the Tree does nothing. The space for the leaves
+// was reserved when the Tree was created, so the quotas are not checked.
+func (t *Tree) AddLeaf(vc ValidationChain, leaf []byte, lIdx int) error {
+	if err := t.f.writable(); err != nil {
+		return err
 	}
-	if isSet := t.leavesComplete[lIdx]; isSet {
-		return
+	if lIdx < 0 || lIdx >= int(t.leaves) || !t.ValidateLeaf(vc, leaf, lIdx) {
+		return ErrBadLeaf
 	}
-	if !t.ValidateLeaf(vc, leaf, lIdx) {
-		return
+	if t.complete || t.leavesComplete[lIdx] {
+		return nil
 	}
+	t.f.treeMux.RLock()
+	defer t.f.treeMux.RUnlock()
 	l := len(leaf)
-	if l < BlockSize {
-		// the only block that can be less than BlockSize is the last block
-		t.lastBlockLen = uint16(l)
-		pad := make([]byte, BlockSize-l)
-		leaf = append(leaf, pad...)
-	}
 
 	// save Leaf
-	v, _ := t.f.writeLeaf(leaf, l)
-	t.leavesComplete[lIdx] = true
+	var v *crypto.Digest
+	var err error
+	if t.leaves == 1 && l <= InlineSize {
+		v, err = t.f.writeInline(leaf, l)
+	} else {
+		if l < t.f.blockSize {
+			pad := make([]byte, t.f.blockSize-l)
+			leaf = append(leaf, pad...)
+		}
+		v, err = t.f.writeLeaf(leaf, l)
+	}
+	if err == nil {
+		err = t.f.syncLeaves()
+	}
+	if err != nil {
+		return err
+	}
 
-	// save branches
-	isLeaf := true
-	var br *branch
-	dirs := dirChain(uint32(lIdx), 0, t.leaves)
-	for i, vd := range vc {
-		var p byte
-		if dirs[i] {
-			if isLeaf {
-				p = lLeafMask
+	// save branches and tree
+	var brs []*branch
+	var saved *Tree
+	err = t.f.meta.Update(func(tx MetaTx) error {
+		brs = brs[:0]
+		isLeaf := true
+		v := v
+		dirs := dirChain(uint32(lIdx), 0, t.leaves)
+		for i, vd := range vc {
+			var p byte
+			var br *branch
+			var err error
+			if dirs[i] {
+				if isLeaf {
+					p = lLeafMask
+				}
+				br, err = getOrCreateBranch(tx, v, vd, p, t.f)
+			} else {
+				if isLeaf {
+					p = rLeafMask
+				}
+				br, err = getOrCreateBranch(tx, vd, v, p, t.f)
 			}
-			br = getOrCreateBranch(v, vd, p, t.f)
-		} else {
-			if isLeaf {
-				p = rLeafMask
+			if err != nil {
+				return err
 			}
-			br = getOrCreateBranch(vd, v, p, t.f)
+			brs = append(brs, br)
+			v = br.dig
+			isLeaf = false
 		}
-		v = br.dig
-		isLeaf = false
-	}
 
-	// compute if complete, save tree
-	t.complete = true
-	for _, leafComplete := range t.leavesComplete {
-		if !leafComplete {
-			t.complete = false
-			break
+		// the record is read again so changes made since t was read, like
+		// leaves added through another Tree or SetMeta, are kept
+		saved = t.f.getTreeTx(tx, t.dig)
+		if saved == nil {
+			return ErrTreeNotFound
+		}
+		if saved.complete || saved.leavesComplete[lIdx] {
+			return nil
+		}
+		if l < t.f.blockSize {
+			// the only block that can be less than the block size is the
+			// last block
+			saved.lastBlockLen = uint16(l)
+		}
+		saved.leavesComplete[lIdx] = true
+		saved.complete = true
+		for _, leafComplete := range saved.leavesComplete {
+			if !leafComplete {
+				saved.complete = false
+				break
+			}
 		}
+		return t.f.writeTreeTx(tx, saved)
+	})
+	if err != nil {
+		return err
 	}
-	t.f.writeTree(t)
+	t.lastBlockLen = saved.lastBlockLen
+	t.leavesComplete = saved.leavesComplete
+	t.complete = saved.complete
+	for _, br := range brs {
+		t.f.branchCache.add(br.dig, *br, branchCost)
+	}
+	t.f.touch(t.dig)
+	return nil
 }
 
-func getOrCreateBranch(l, r *crypto.Digest, p byte, f *Forest) *branch {
+func getOrCreateBranch(tx MetaTx, l, r *crypto.Digest, p byte, f *Forest) (*branch, error) {
 	d := crypto.GetDigest(l.Slice(), r.Slice())
-	br := f.readBranch(d)
+	br := f.readBranchTx(tx, d)
 	if br == nil {
 		br = &branch{
 			dig:     d,
@@ -132,10 +259,11 @@ func getOrCreateBranch(l, r *crypto.Digest, p byte, f *Forest) *branch {
 			right:   r,
 			pattern: p,
 		}
-	} else {
-		br.pattern |= p
+		if err := f.refChildren(tx, br); err != nil {
+			return nil, err
+		}
+	} else if err := f.markLeaves(tx, br, p); err != nil {
+		return nil, err
 	}
-	f.writeBranch(br)
-
-	return br
+	return br, f.writeBranchTx(tx, br)
 }
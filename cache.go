@@ -0,0 +1,140 @@
+package merkle
+
+import (
+	"container/list"
+	"github.com/dist-ribut-us/crypto"
+	"sync"
+)
+
+// DefaultLeafCacheSize is the default memory limit, in bytes, of the cache of
+// decrypted leaves.
+const DefaultLeafCacheSize = 4 << 20
+
+// DefaultBranchCacheSize is the default memory limit, in bytes, of the cache of
+// decrypted branches.
+const DefaultBranchCacheSize = 1 << 20
+
+// branchCost is the approximate memory used by a cached branch.
+const branchCost = crypto.DigestLength*3 + 64
+
+// CacheStats reports the use of the leaf and branch caches.
+type CacheStats struct {
+	LeafHits, LeafMisses     uint64
+	BranchHits, BranchMisses uint64
+	LeafBytes, BranchBytes   int
+}
+
+// lru is a least recently used cache bounded by the total size of the values.
+// A nil *lru is a valid cache that holds nothing.
+type lru struct {
+	sync.Mutex
+	max, size    int
+	ll           *list.List
+	items        map[crypto.Digest]*list.Element
+	hits, misses uint64
+}
+
+type lruEntry struct {
+	key  crypto.Digest
+	val  interface{}
+	size int
+}
+
+// newLRU returns an lru holding at most max bytes. If max is negative, it
+// returns nil, which caches nothing.
+func newLRU(max int) *lru {
+	if max < 0 {
+		return nil
+	}
+	return &lru{
+		max:   max,
+		ll:    list.New(),
+		items: make(map[crypto.Digest]*list.Element),
+	}
+}
+
+func (c *lru) get(d *crypto.Digest) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.items[*d]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.ll.MoveToFront(e)
+	return e.Value.(*lruEntry).val, true
+}
+
+func (c *lru) add(d *crypto.Digest, val interface{}, size int) {
+	if c == nil || size > c.max {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.items[*d]; ok {
+		en := e.Value.(*lruEntry)
+		c.size += size - en.size
+		en.val, en.size = val, size
+		c.ll.MoveToFront(e)
+	} else {
+		c.items[*d] = c.ll.PushFront(&lruEntry{
+			key:  *d,
+			val:  val,
+			size: size,
+		})
+		c.size += size
+	}
+	for c.size > c.max {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *lru) remove(d *crypto.Digest) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	if e, ok := c.items[*d]; ok {
+		c.removeElement(e)
+	}
+	c.Unlock()
+}
+
+func (c *lru) purge() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	c.ll.Init()
+	c.items = make(map[crypto.Digest]*list.Element)
+	c.size = 0
+	c.Unlock()
+}
+
+func (c *lru) removeElement(e *list.Element) {
+	en := c.ll.Remove(e).(*lruEntry)
+	delete(c.items, en.key)
+	c.size -= en.size
+}
+
+func (c *lru) stats() (hits, misses uint64, size int) {
+	if c == nil {
+		return 0, 0, 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.hits, c.misses, c.size
+}
+
+// CacheStats returns the hit and miss counts and the memory used by the leaf
+// and branch caches.
+func (f *Forest) CacheStats() CacheStats {
+	var s CacheStats
+	s.LeafHits, s.LeafMisses, s.LeafBytes = f.leafCache.stats()
+	s.BranchHits, s.BranchMisses, s.BranchBytes = f.branchCache.stats()
+	return s
+}
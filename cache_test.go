@@ -0,0 +1,94 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestLRU(t *testing.T) {
+	c := newLRU(30)
+	d1 := crypto.GetDigest([]byte("1"))
+	d2 := crypto.GetDigest([]byte("2"))
+	d3 := crypto.GetDigest([]byte("3"))
+
+	c.add(d1, 1, 10)
+	c.add(d2, 2, 10)
+	c.add(d3, 3, 10)
+	v, ok := c.get(d1)
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	// d2 is the least recently used
+	c.add(d3, 3, 20)
+	_, ok = c.get(d2)
+	assert.False(t, ok)
+	_, ok = c.get(d1)
+	assert.True(t, ok)
+
+	// too big to cache
+	c.add(d2, 2, 31)
+	_, ok = c.get(d2)
+	assert.False(t, ok)
+
+	hits, misses, size := c.stats()
+	assert.Equal(t, uint64(2), hits)
+	assert.Equal(t, uint64(2), misses)
+	assert.Equal(t, 30, size)
+
+	var nilCache *lru
+	nilCache.add(d1, 1, 1)
+	_, ok = nilCache.get(d1)
+	assert.False(t, ok)
+}
+
+func TestForestCache(t *testing.T) {
+	f := OpenMemory(crypto.RandomSymmetric())
+
+	data := make([]byte, BlockSize*8)
+	rand.Read(data)
+	tr, err := f.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	out := make([]byte, 1000)
+	var read []byte
+	for {
+		n, err := tr.Read(out)
+		read = append(read, out[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+	assert.Equal(t, data, read)
+
+	s := f.CacheStats()
+	assert.True(t, s.LeafMisses <= uint64(tr.leaves))
+	assert.True(t, s.LeafHits > s.LeafMisses)
+	assert.True(t, s.BranchMisses < uint64(tr.leaves))
+	assert.True(t, s.BranchHits > 0)
+	assert.True(t, s.LeafBytes > 0)
+	f.Close()
+
+	f, err = newForest(crypto.RandomSymmetric(), newMemMeta(), newMemStore(), &Options{
+		LeafCacheSize:   -1,
+		BranchCacheSize: -1,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	tr, err = f.BuildTree(bytes.NewReader(data))
+	assert.NoError(t, err)
+	read, err = tr.ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data, read)
+	assert.Equal(t, CacheStats{}, f.CacheStats())
+	f.Close()
+}
@@ -0,0 +1,56 @@
+package merkle
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"time"
+)
+
+// ExpireNow removes every tree that has expired and returns how many were
+// removed. Pinned trees are kept, as are leaves and branches that are still
+// used by another tree.
+func (f *Forest) ExpireNow() (int, error) {
+	if err := f.writable(); err != nil {
+		return 0, err
+	}
+	f.treeMux.Lock()
+	defer f.treeMux.Unlock()
+
+	now := f.clock()
+	var n int
+	var dead []*crypto.Digest
+	err := f.meta.Update(func(tx MetaTx) error {
+		n, dead = 0, dead[:0]
+		var expired []*crypto.Digest
+		err := f.eachTree(tx, func(t *Tree) error {
+			if t.expired(now) && f.getPinTx(tx, t.dig) == 0 {
+				expired = append(expired, t.dig)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, d := range expired {
+			if err = f.deleteTreeTx(tx, d, &dead); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, f.removeLeaves(dead)
+}
+
+// laterExpiry returns the later of two expiry times, where zero is never.
+func laterExpiry(a, b time.Time) time.Time {
+	if a.IsZero() || b.IsZero() {
+		return time.Time{}
+	}
+	if a.After(b) {
+		return a
+	}
+	return b
+}
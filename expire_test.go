@@ -0,0 +1,137 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+	c.Unlock()
+}
+
+func TestExpire(t *testing.T) {
+	clock := &testClock{now: time.Unix(1000000, 0)}
+	f, err := newForest(crypto.RandomSymmetric(), newMemMeta(), newMemStore(), &Options{
+		Clock: clock.Now,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	store := f.leaves.(*memStore)
+
+	data := make([]byte, BlockSize*3)
+	rand.Read(data)
+	hour := clock.Now().Add(time.Hour)
+	a, err := f.BuildTreeWithOptions(bytes.NewReader(data[:BlockSize*2]), &TreeOptions{Expires: hour})
+	if !assert.NoError(t, err) {
+		return
+	}
+	b, err := f.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	s, err := f.NewWithOptions(crypto.GetDigest([]byte("sapling")), 10, &TreeOptions{Expires: hour})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.True(t, hour.Equal(f.GetTree(a.Digest()).Expires()))
+	assert.True(t, hour.Equal(f.GetTree(s.Digest()).Expires()))
+	assert.True(t, f.GetTree(b.Digest()).Expires().IsZero())
+
+	n, err := f.ExpireNow()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	clock.Add(time.Hour)
+	assert.Nil(t, f.GetTree(a.Digest()))
+	assert.Nil(t, f.GetTree(s.Digest()))
+
+	n, err = f.ExpireNow()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 2, bucketLen(f, treeBkt))
+	assertRefsConsistent(t, f)
+
+	// b shares leaves with a, so they were kept
+	assert.Equal(t, 4, len(store.leaves))
+	out, err := f.GetTree(b.Digest()).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+
+	// building an existing tree keeps the later expiry
+	_, err = f.BuildTreeWithOptions(bytes.NewReader(data), &TreeOptions{Expires: hour})
+	assert.NoError(t, err)
+	assert.True(t, f.GetTree(b.Digest()).Expires().IsZero())
+}
+
+func TestExpirer(t *testing.T) {
+	dirStr := "TestExpirer"
+	os.RemoveAll(dirStr)
+	clock := &testClock{now: time.Unix(1000000, 0)}
+	f, err := OpenWithOptions(dirStr, crypto.RandomSymmetric(), &Options{
+		Clock:          clock.Now,
+		ExpireInterval: time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	data := make([]byte, 100)
+	rand.Read(data)
+	tr, err := f.BuildTreeWithOptions(bytes.NewReader(data), &TreeOptions{
+		Expires: clock.Now().Add(time.Minute),
+	})
+	assert.NoError(t, err)
+	clock.Add(time.Minute)
+
+	for i := 0; i < 100 && bucketLen(f, treeBkt) > 1; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, 1, bucketLen(f, treeBkt))
+	assert.Nil(t, f.GetTree(tr.Digest()))
+
+	f.Close()
+	assert.NoError(t, os.RemoveAll(dirStr))
+}
+
+func TestExpirerError(t *testing.T) {
+	meta := &failMeta{memMeta: newMemMeta()}
+	errs := make(chan error, 100)
+	f, err := newForest(crypto.RandomSymmetric(), meta, newMemStore(), &Options{
+		ExpireInterval: time.Millisecond,
+		OnError:        func(err error) { errs <- err },
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	testErr := errors.String("test error")
+	meta.fail(testErr)
+	select {
+	case err := <-errs:
+		assert.Equal(t, testErr, err)
+	case <-time.After(time.Second * 5):
+		t.Error("timed out")
+	}
+	f.Close()
+}
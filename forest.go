@@ -2,22 +2,45 @@ package merkle
 
 import (
 	"bytes"
-	"encoding/hex"
-	"github.com/boltdb/bolt"
 	"github.com/dist-ribut-us/crypto"
 	"github.com/dist-ribut-us/errors"
 	"github.com/dist-ribut-us/serial"
-	"os"
+	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Forest is a directory used to store Merkle Trees. A Forest has a symmetric
 // encryption key that is used to secure the data. It also has a Bolt DB file
-// to store structural information (branches and roots).
+// to store structural information (branches and roots). The leaves are kept in
+// a LeafStore, by default a DirStore in the same directory.
 type Forest struct {
-	key *crypto.Symmetric
-	dir string
-	db  *bolt.DB
+	keys        atomic.Value
+	dir         string
+	meta        MetaStore
+	leaves      LeafStore
+	durability  Durability
+	readOnly    bool
+	created     bool
+	blockSize   int
+	blocks      *sync.Pool
+	clock       func() time.Time
+	budget      int64
+	quota       int64
+	nsQuotas    map[string]int64
+	onError     func(error)
+	accessMux   sync.Mutex
+	accessed    map[crypto.Digest]time.Time
+	flushNow    chan struct{}
+	stop        chan struct{}
+	bg          sync.WaitGroup
+	leafCache   *lru
+	branchCache *lru
+	// treeMux is held for reading while writing and for writing while deleting
+	// or rekeying, so a leaf can't be deleted while a tree is being built on it
+	// and nothing is written under the old key.
+	treeMux sync.RWMutex
 }
 
 var branchBkt = []byte("b")
@@ -28,196 +51,529 @@ var validateKey = []byte("__key__")
 // not exist.
 const ErrBucketDoesNotExist = errors.String("Bucket does not exist")
 
-var openOptions = &bolt.Options{
-	Timeout: time.Second,
-}
+// ErrReadOnly is returned when trying to write to a read only Forest.
+const ErrReadOnly = errors.String("Forest is read only")
 
 // Open will either open or creates a new Forest
 func Open(dirStr string, key *crypto.Symmetric) (*Forest, error) {
-	if err := os.MkdirAll(dirStr, 0777); err != nil {
-		return nil, err
+	return OpenWithOptions(dirStr, key, nil)
+}
+
+// OpenReadOnly opens an existing Forest without allowing any writes. The Bolt
+// DB is opened with a shared lock so any number of processes can open the same
+// Forest read only, though not while it is open for writing.
+func OpenReadOnly(dirStr string, key *crypto.Symmetric) (*Forest, error) {
+	return OpenWithOptions(dirStr, key, &Options{
+		ReadOnly: true,
+	})
+}
+
+// ReadOnly returns true if the Forest was opened read only.
+func (f *Forest) ReadOnly() bool { return f.readOnly }
+
+// OpenWithStore opens or creates a Forest that keeps its leaves in store. The
+// Bolt DB is still kept in dirStr. If store is nil, a DirStore in dirStr is
+// used.
+func OpenWithStore(dirStr string, key *crypto.Symmetric, store LeafStore) (*Forest, error) {
+	return OpenWithOptions(dirStr, key, &Options{
+		LeafStore: store,
+	})
+}
+
+// OpenMemory creates a Forest that is only held in memory. It is fully
+// functional but nothing is written to disk and everything is lost when it is
+// closed. It is intended for tests and short lived caches.
+func OpenMemory(key *crypto.Symmetric) *Forest {
+	f, _ := newForest(key, newMemMeta(), newMemStore(), nil)
+	return f
+}
+
+// newForest sets up the buckets and validates the key. If there is an error,
+// the MetaStore will be closed.
+func newForest(key *crypto.Symmetric, meta MetaStore, store LeafStore, opts *Options) (*Forest, error) {
+	opts = opts.withDefaults()
+	f := &Forest{
+		meta:        meta,
+		leaves:      store,
+		readOnly:    opts.ReadOnly,
+		clock:       opts.Clock,
+		budget:      opts.DiskBudget,
+		quota:       opts.Quota,
+		nsQuotas:    opts.NamespaceQuotas,
+		onError:     opts.OnError,
+		accessed:    make(map[crypto.Digest]time.Time),
+		leafCache:   newLRU(opts.LeafCacheSize),
+		branchCache: newLRU(opts.BranchCacheSize),
 	}
-	dir, err := os.Open(dirStr)
-	if err != nil {
-		return nil, err
+	f.setKeys(key, nil)
+	setup := func(tx MetaTx) error { return f.setup(tx, opts) }
+	var err error
+	if f.readOnly {
+		err = meta.View(setup)
+	} else {
+		err = meta.Update(setup)
 	}
-	db, err := bolt.Open(dir.Name()+"/merkle.db", 0777, openOptions)
 	if err != nil {
+		meta.Close()
 		return nil, err
 	}
-	err = db.Update(func(tx *bolt.Tx) error {
-		tx.CreateBucketIfNotExists(branchBkt)
-		b, _ := tx.CreateBucketIfNotExists(treeBkt)
-		// the key validation is stored in the treeBkt because it is unlikely
-		// to collied with a tree
-		v := b.Get(validateKey)
-		if v == nil {
-			b.Put(validateKey, key.Seal(validateKey, nil))
-		} else {
-			if v, err = key.Open(v); err != nil {
-				return err
-			} else if !bytes.Equal(v, validateKey) {
-				return crypto.ErrDecryptionFailed
-			}
+	bs := f.blockSize
+	f.blocks = &sync.Pool{
+		New: func() interface{} {
+			return make([]byte, bs)
+		},
+	}
+	if a, ok := store.(forestStore); ok {
+		if err = a.attach(f); err != nil {
+			meta.Close()
+			return nil, err
 		}
-		return nil
-	})
-	if err != nil {
-		db.Close()
-		return nil, err
 	}
-	f := &Forest{
-		key: key,
-		db:  db,
-		dir: dir.Name(),
+	f.SetDurability(opts.Durability)
+	if !f.readOnly {
+		f.flushNow = make(chan struct{}, 1)
+		f.every(accessFlushInterval, f.flushNow, f.flushAccess)
+		if opts.ExpireInterval > 0 {
+			f.every(opts.ExpireInterval, nil, func() error {
+				_, err := f.ExpireNow()
+				return err
+			})
+		}
+		if opts.EvictInterval > 0 && f.budget > 0 {
+			f.every(opts.EvictInterval, nil, func() error {
+				_, err := f.Evict()
+				return err
+			})
+		}
 	}
+	return f, nil
+}
 
-	err = dir.Close()
-
-	return f, err
+// every calls fn every interval in the background until the Forest is closed,
+// and as well each time something is sent on now. Errors are passed to the
+// OnError callback from the Options.
+func (f *Forest) every(interval time.Duration, now <-chan struct{}, fn func() error) {
+	if f.stop == nil {
+		f.stop = make(chan struct{})
+	}
+	f.bg.Add(1)
+	go func() {
+		defer f.bg.Done()
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-f.stop:
+				return
+			case <-tick.C:
+			case <-now:
+			}
+			if err := fn(); err != nil && f.onError != nil {
+				f.onError(err)
+			}
+		}
+	}()
 }
 
 // Close will close a Forest, specifically, it will close the Bolt DB and
-// directory.
+// directory. If the LeafStore is an io.Closer, it will be closed as well. Any
+// background work is stopped first.
 func (f *Forest) Close() {
-	f.db.Close()
+	if f.stop != nil {
+		close(f.stop)
+		f.bg.Wait()
+		f.stop = nil
+	}
+	f.flushAccess()
+	f.meta.Close()
+	if c, ok := f.leaves.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// SetDurability sets when leaves are flushed to disk. It only has an effect if
+// the LeafStore is a SyncStore. The Bolt DB is always synced when it is
+// written.
+func (f *Forest) SetDurability(d Durability) {
+	f.durability = d
+	if s, ok := f.leaves.(SyncStore); ok {
+		s.SetDurability(d)
+	}
+}
+
+// syncLeaves is called after the leaves of a tree are written and before the
+// tree is saved.
+func (f *Forest) syncLeaves() error {
+	if f.durability != SyncTree {
+		return nil
+	}
+	if s, ok := f.leaves.(SyncStore); ok {
+		return s.Sync()
+	}
+	return nil
 }
 
 var zeroNonce = &crypto.Nonce{}
 
+// sealDigest returns the encrypted form of a digest that is used as a key in
+// the Bolt DB and the LeafStore. It uses the zeroNonce so that the same digest
+// always produces the same key.
+func (f *Forest) sealDigest(d *crypto.Digest) []byte {
+	return seal(f.key(), d.Slice())
+}
+
+// seal encrypts a key with the zeroNonce.
+func seal(key *crypto.Symmetric, b []byte) []byte {
+	return key.Seal(b, zeroNonce)[crypto.NonceLength:]
+}
+
 func (f *Forest) readBranch(d *crypto.Digest) *branch {
-	cd := f.key.Seal(d.Slice(), zeroNonce)[crypto.NonceLength:]
-	var s []byte
-	f.db.View(func(tx *bolt.Tx) error {
-		s = tx.Bucket(branchBkt).Get(cd)
+	if c, ok := f.branchCache.get(d); ok {
+		b := c.(branch)
+		return &b
+	}
+	var b *branch
+	f.meta.View(func(tx MetaTx) error {
+		b = f.readBranchTx(tx, d)
 		return nil
 	})
+	if b != nil {
+		f.branchCache.add(d, *b, branchCost)
+	}
+	return b
+}
+
+// readBranchTx reads a branch inside a transaction, so it will see writes that
+// have not been committed. It does not use the cache.
+func (f *Forest) readBranchTx(tx MetaTx, d *crypto.Digest) *branch {
+	s := f.getSealed(tx.Bucket(branchBkt), d.Slice())
 	if s == nil {
 		return nil
 	}
-	s, _ = f.key.Open(s)
+	s, _ = f.open(s)
 	b := unmarshalBranch(s)
-	if !b.dig.Equal(d) {
-		// TODO: in this case something has gone very wrong, we should probably at
-		// least delete the record.
+	if b == nil || !b.dig.Equal(d) {
+		// the record is corrupt, Verify will report it and Repair will
+		// quarantine it
 		return nil
 	}
 	return b
 }
 
 func (f *Forest) writeBranch(b *branch) error {
-	s := f.key.Seal(b.marshal(), nil)
-	cd := f.key.Seal(b.dig.Slice(), zeroNonce)[crypto.NonceLength:]
-	return f.db.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket(branchBkt).Put(cd, s)
+	if err := f.writable(); err != nil {
+		return err
+	}
+	err := f.meta.Update(func(tx MetaTx) error {
+		return f.writeBranchTx(tx, b)
 	})
+	if err == nil {
+		f.branchCache.add(b.dig, *b, branchCost)
+	}
+	return err
 }
 
-func (f *Forest) writeLeaf(b []byte, l int) (*crypto.Digest, error) {
-	d := crypto.GetDigest(b[:l])
-	cd := f.key.Seal(d.Slice(), zeroNonce)[crypto.NonceLength:]
-	data := f.key.Seal(b, nil)
+// writeBranchTx saves a branch inside a transaction. The caller should update
+// the cache once the transaction is committed.
+func (f *Forest) writeBranchTx(tx MetaTx, b *branch) error {
+	return tx.Bucket(branchBkt).Put(f.sealDigest(b.dig), f.key().Seal(b.marshal(), nil))
+}
 
-	filename := hex.EncodeToString(cd)
-	var file *os.File
-	var err error
-	if file, err = os.Create(f.dir + "/" + filename); err == nil {
-		_, err = file.Write(data)
-		file.Close()
+func (f *Forest) writeLeaf(b []byte, l int) (*crypto.Digest, error) {
+	if err := f.writable(); err != nil {
+		return nil, err
 	}
-	return d, err
+	d := crypto.GetDigest(b[:l])
+	return d, f.leaves.Put(f.sealDigest(d), f.key().Seal(b, nil))
 }
 
 const overhead = crypto.Overhead + crypto.NonceLength
 
+// hasLeaf checks if a leaf is already saved, inline or in the LeafStore.
+func (f *Forest) hasLeaf(d *crypto.Digest) bool {
+	cd := f.sealDigest(d)
+	if f.readInline(cd) != nil {
+		return true
+	}
+	ok, _ := f.leaves.Has(cd)
+	return ok
+}
+
+// readLeaf returns the padded leaf. Leaves stored inline are padded to their
+// size class instead of the block size. If the leaf can't be decrypted,
+// ErrCorrupt is returned.
 func (f *Forest) readLeaf(d *crypto.Digest) ([]byte, error) {
-	cd := f.key.Seal(d.Slice(), zeroNonce)[crypto.NonceLength:]
-	filename := hex.EncodeToString(cd)
-	// Not sure why, but if the block is exactly the right size it freezes during
-	// read, so we tack one extra byte on, then remove it.
-	b := make([]byte, BlockSize+overhead+1)
-	file, err := os.Open(f.dir + "/" + filename)
+	if c, ok := f.leafCache.get(d); ok {
+		return append([]byte(nil), c.([]byte)...), nil
+	}
+	b, err := f.getLeaf(d)
 	if err != nil {
 		return nil, err
 	}
-	var l, i int
-	for l, err = file.Read(b); err == nil; l, err = file.Read(b[i:]) {
-		i += l
+	if b, err = f.open(b); err != nil {
+		return nil, ErrCorrupt
 	}
-	if err.Error() == "EOF" {
-		err = nil
+	f.leafCache.add(d, append([]byte(nil), b...), len(b))
+	return b, nil
+}
+
+// getLeaf returns the encrypted leaf from the inline bucket or the LeafStore.
+// While the Forest is being rekeyed, the leaf may still be under its old name.
+func (f *Forest) getLeaf(d *crypto.Digest) ([]byte, error) {
+	var err error = ErrLeafNotFound
+	for _, cd := range f.sealedKeys(d.Slice()) {
+		if b := f.readInline(cd); b != nil {
+			return b, nil
+		}
+		var b []byte
+		if b, err = f.leaves.Get(cd); err != ErrLeafNotFound {
+			return b, err
+		}
 	}
-	b = b[:i+l] // remove extra byte
+	return nil, err
+}
 
-	b, err = f.key.Open(b)
-	if err != nil {
-		return nil, err
+func (f *Forest) writeTree(t *Tree) error {
+	if err := f.writable(); err != nil {
+		return err
 	}
-	err = file.Close()
+	return f.meta.Update(func(tx MetaTx) error {
+		return f.writeTreeTx(tx, t)
+	})
+}
 
-	return b, err
+// writeTreeTx saves the tree record. If the record is new, it takes a reference
+// to the root. The stats and the usage of the tree's namespace are updated and
+// the usage is checked against the quotas.
+func (f *Forest) writeTreeTx(tx MetaTx, t *Tree) error {
+	return f.saveTreeTx(tx, t, true)
 }
 
-func (f *Forest) writeTree(t *Tree) {
-	key := f.key.Seal(t.dig.Slice(), zeroNonce)[crypto.NonceLength:]
+// saveTreeTx is writeTreeTx, but the quotas are only checked if checkQuota is
+// true.
+func (f *Forest) saveTreeTx(tx MetaTx, t *Tree, checkQuota bool) error {
+	key := f.sealDigest(t.dig)
+	old := f.getTreeTx(tx, t.dig)
+	delta := treeStats(t)
+	delta.add(treeStats(old), -1)
+	if tx.Bucket(treeBkt).Get(key) == nil {
+		if _, err := f.addRef(tx, t.dig, 1, boolCount(t.rootIsLeaf())); err != nil {
+			return err
+		}
+	} else if old != nil && old.rootIsLeaf() != t.rootIsLeaf() {
+		// a single leaf sapling that was completed or demoted
+		leaves := boolCount(t.rootIsLeaf()) - boolCount(old.rootIsLeaf())
+		if _, err := f.addRef(tx, t.dig, 0, leaves); err != nil {
+			return err
+		}
+	}
+	if err := f.addStatsTx(tx, delta); err != nil {
+		return err
+	}
+	if old == nil || old.namespace != t.namespace || old.quotaSize() != t.quotaSize() {
+		charge := f.chargeTx
+		if !checkQuota {
+			charge = f.addUsageTx
+		}
+		if old != nil && old.namespace == t.namespace {
+			// only the change is charged, so a tree that shrinks, like a
+			// sapling being completed, is never refused
+			if err := charge(tx, t.namespace, t.quotaSize()-old.quotaSize()); err != nil {
+				return err
+			}
+		} else {
+			if old != nil {
+				if err := f.addUsageTx(tx, old.namespace, -old.quotaSize()); err != nil {
+					return err
+				}
+			}
+			if err := charge(tx, t.namespace, t.quotaSize()); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Bucket(treeBkt).Put(key, f.key().Seal(t.marshal(), nil))
+}
+
+// The tree record starts with the leaf count, the last block length and a
+// flags byte. Optional fields follow in the order of their flags, then the
+// leaves that are complete if the tree is not.
+const (
+	treeComplete byte = 1 << iota
+	treeExpires
+	treeNamespace
+	treeHasMeta
+)
+
+func (t *Tree) marshal() []byte {
+	var flags byte
 	l := 7
-	if !t.complete {
+	if t.complete {
+		flags |= treeComplete
+	} else {
 		l += 4 + (int(t.leaves) / 8)
 		if t.leaves%8 != 0 {
 			l++
 		}
 	}
+	if !t.expires.IsZero() {
+		flags |= treeExpires
+		l += 8
+	}
+	if t.namespace != "" {
+		flags |= treeNamespace
+		l += 2 + len(t.namespace)
+	}
+	if t.meta != nil {
+		flags |= treeHasMeta
+		l += t.meta.size()
+	}
 	b := make([]byte, l)
 	serial.MarshalUint32(t.leaves, b)
 	serial.MarshalUint16(t.lastBlockLen, b[4:])
-	if t.complete {
-		b[6] = 1
-	} else {
-		serial.MarshalBoolSlice(t.leavesComplete, b[7:])
+	b[6] = flags
+	off := 7
+	if flags&treeExpires != 0 {
+		marshalTime(t.expires, b[off:])
+		off += 8
 	}
-	val := f.key.Seal(b, nil)
-	f.db.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket(treeBkt).Put(key, val)
-	})
+	if flags&treeNamespace != 0 {
+		off += marshalString(t.namespace, b[off:])
+	}
+	if flags&treeHasMeta != 0 {
+		off += t.meta.marshal(b[off:])
+	}
+	if !t.complete {
+		serial.MarshalBoolSlice(t.leavesComplete, b[off:])
+	}
+	return b
+}
+
+func unmarshalTree(b []byte) *Tree {
+	if len(b) < 7 {
+		return nil
+	}
+	t := &Tree{
+		leaves:       serial.UnmarshalUint32(b),
+		lastBlockLen: serial.UnmarshalUint16(b[4:]),
+	}
+	flags := b[6]
+	b = b[7:]
+	if flags&treeExpires != 0 {
+		if len(b) < 8 {
+			return nil
+		}
+		t.expires = unmarshalTime(b)
+		b = b[8:]
+	}
+	if flags&treeNamespace != 0 {
+		var n int
+		if t.namespace, n = unmarshalString(b); n == 0 {
+			return nil
+		}
+		b = b[n:]
+	}
+	if flags&treeHasMeta != 0 {
+		var n int
+		if t.meta, n = unmarshalTreeMeta(b); t.meta == nil {
+			return nil
+		}
+		b = b[n:]
+	}
+	t.complete = flags&treeComplete != 0
+	if !t.complete {
+		t.leavesComplete = serial.UnmarshalBoolSlice(b)
+	}
+	return t
 }
 
 // GetTree will return a Tree from a Forest. It is only a reference to the
-// Tree, not the data in the tree. If the tree is not found, it will return nil.
+// Tree, not the data in the tree. If the tree is not found or has expired and
+// is not pinned, it will return nil.
 func (f *Forest) GetTree(d *crypto.Digest) *Tree {
-	key := f.key.Seal(d.Slice(), zeroNonce)[crypto.NonceLength:]
-	var b []byte
-	f.db.View(func(tx *bolt.Tx) error {
-		b = tx.Bucket(treeBkt).Get(key)
+	var t *Tree
+	f.meta.View(func(tx MetaTx) error {
+		t = f.getTreeTx(tx, d)
+		if t != nil && t.expired(f.clock()) && f.getPinTx(tx, d) == 0 {
+			t = nil
+		}
 		return nil
 	})
-	if len(b) < 7 {
+	if t == nil {
+		return nil
+	}
+	f.touch(d)
+	return t
+}
+
+func (f *Forest) getTreeTx(tx MetaTx, d *crypto.Digest) *Tree {
+	b := f.getSealed(tx.Bucket(treeBkt), d.Slice())
+	if b == nil {
 		return nil
 	}
-	val, _ := f.key.Open(b)
-	l := serial.UnmarshalUint32(val)
-	lbl := serial.UnmarshalUint16(val[4:])
-	complete := val[6] == 1
-	var leavesComplete []bool
-	if !complete {
-		leavesComplete = serial.UnmarshalBoolSlice(val[7:])
+	val, err := f.open(b)
+	if err != nil {
+		return nil
+	}
+	t := unmarshalTree(val)
+	if t != nil {
+		t.dig = d
+		t.f = f
 	}
-	return &Tree{
-		dig:            d,
-		leaves:         l,
-		f:              f,
-		lastBlockLen:   lbl,
-		complete:       complete,
-		leavesComplete: leavesComplete,
+	return t
+}
+
+// treeDigests returns the digest of every tree record, skipping the key
+// validation record and any key that can't be decrypted.
+func (f *Forest) treeDigests(tx MetaTx) []*crypto.Digest {
+	ds, _ := f.treeKeys(tx)
+	return ds
+}
+
+// treeKeys is treeDigests but it also returns the keys that can't be
+// decrypted.
+func (f *Forest) treeKeys(tx MetaTx) ([]*crypto.Digest, [][]byte) {
+	var ds []*crypto.Digest
+	var bad [][]byte
+	c := tx.Bucket(treeBkt).Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if bytes.Equal(k, validateKey) {
+			continue
+		}
+		d, err := f.openKey(k, zeroNonce)
+		if err != nil || len(d) != crypto.DigestLength {
+			bad = append(bad, append([]byte(nil), k...))
+			continue
+		}
+		ds = append(ds, crypto.DigestFromSlice(d))
 	}
+	return ds, bad
+}
+
+// eachTree calls fn for every tree record that can be read.
+func (f *Forest) eachTree(tx MetaTx, fn func(t *Tree) error) error {
+	for _, d := range f.treeDigests(tx) {
+		if t := f.getTreeTx(tx, d); t != nil {
+			if err := fn(t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // SetValue saves a single value to the Bolt Database. It does not use the
 // Merkle tree structure, but provides a simple method to store secure
 // information in the same container as the trees
 func (f *Forest) SetValue(bucket, key, value []byte) error {
-	key = f.key.Seal(key, zeroNonce)[crypto.NonceLength:]
-	value = f.key.Seal(value, nil)
-	return f.db.Update(func(tx *bolt.Tx) error {
+	f.treeMux.RLock()
+	defer f.treeMux.RUnlock()
+	if err := f.writable(); err != nil {
+		return err
+	}
+	key = seal(f.key(), key)
+	value = f.key().Seal(value, nil)
+	return f.meta.Update(func(tx MetaTx) error {
 		btk, err := tx.CreateBucketIfNotExists(bucket)
 		if err != nil {
 			return err
@@ -230,20 +586,19 @@ func (f *Forest) SetValue(bucket, key, value []byte) error {
 // It does not use the Merkle tree structure, but provides a simple method to
 // store secure information in the same container as the trees
 func (f *Forest) GetValue(bucket, key []byte) ([]byte, error) {
-	key = f.key.Seal(key, zeroNonce)[crypto.NonceLength:]
 	var c []byte
-	err := f.db.View(func(tx *bolt.Tx) error {
+	err := f.meta.View(func(tx MetaTx) error {
 		bkt := tx.Bucket(bucket)
 		if bkt == nil {
 			return ErrBucketDoesNotExist
 		}
-		c = bkt.Get(key)
+		c = f.getSealed(bkt, key)
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	return f.key.Open(c)
+	return f.open(c)
 }
 
 // First returns the first key/value pair in the bucket
@@ -252,7 +607,7 @@ func (f *Forest) First(bucket []byte) ([]byte, []byte, error) {
 		key []byte
 		val []byte
 	)
-	f.db.View(func(tx *bolt.Tx) error {
+	f.meta.View(func(tx MetaTx) error {
 		bkt := tx.Bucket(bucket)
 		if bkt == nil {
 			return ErrBucketDoesNotExist
@@ -260,11 +615,11 @@ func (f *Forest) First(bucket []byte) ([]byte, []byte, error) {
 		key, val = bkt.Cursor().First()
 		return nil
 	})
-	key, err := f.key.NonceOpen(key, nil)
+	key, err := f.openKey(key, nil)
 	if err != nil {
 		return nil, nil, err
 	}
-	val, err = f.key.Open(val)
+	val, err = f.open(val)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -273,32 +628,33 @@ func (f *Forest) First(bucket []byte) ([]byte, []byte, error) {
 
 // Next takes a searchKey and returns the next key/value after it
 func (f *Forest) Next(bucket, searchKey []byte) ([]byte, []byte, error) {
-	searchKey = f.key.Seal(searchKey, zeroNonce)[crypto.NonceLength:]
 	var (
 		key []byte
 		val []byte
 	)
-	err := f.db.View(func(tx *bolt.Tx) error {
+	err := f.meta.View(func(tx MetaTx) error {
 		bkt := tx.Bucket(bucket)
 		if bkt == nil {
 			return ErrBucketDoesNotExist
 		}
 		c := bkt.Cursor()
-		key, val = c.Seek(searchKey)
-		if !bytes.Equal(key, searchKey) {
-			return nil
+		for _, sk := range f.sealedKeys(searchKey) {
+			key, val = c.Seek(sk)
+			if bytes.Equal(key, sk) {
+				key, val = c.Next()
+				return nil
+			}
 		}
-		key, val = c.Next()
 		return nil
 	})
 	if err != nil {
 		return nil, nil, err
 	}
-	key, err = f.key.NonceOpen(key, nil)
+	key, err = f.openKey(key, nil)
 	if err != nil {
 		return nil, nil, err
 	}
-	val, err = f.key.Open(val)
+	val, err = f.open(val)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -308,7 +664,10 @@ func (f *Forest) Next(bucket, searchKey []byte) ([]byte, []byte, error) {
 // MakeBuckets takes a list of buckets and calls CreateBucketIfNotExists on each
 // of them.
 func (f *Forest) MakeBuckets(bkts ...[]byte) error {
-	return f.db.Update(func(tx *bolt.Tx) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	return f.meta.Update(func(tx MetaTx) error {
 		for _, bkt := range bkts {
 			_, err := tx.CreateBucketIfNotExists(bkt)
 			if err != nil {
@@ -6,9 +6,11 @@ import (
 	"encoding/hex"
 	"github.com/dist-ribut-us/crypto"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestLeafFilename(t *testing.T) {
@@ -88,19 +90,12 @@ func TestForrest(t *testing.T) {
 }
 
 func TestValue(t *testing.T) {
-	dirStr := "TestValue"
-	os.RemoveAll(dirStr)
-	key := crypto.RandomSymmetric()
-
-	f, err := Open(dirStr, key)
-	if !assert.NoError(t, err) {
-		return
-	}
+	f := OpenMemory(crypto.RandomSymmetric())
 
 	k := make([]byte, 20)
 	v := make([]byte, 200)
 
-	_, err = rand.Read(k)
+	_, err := rand.Read(k)
 	assert.NoError(t, err)
 	_, err = rand.Read(v)
 	assert.NoError(t, err)
@@ -146,5 +141,66 @@ func TestValue(t *testing.T) {
 	assert.Nil(t, tv)
 
 	f.Close()
+}
+
+func TestReadOnly(t *testing.T) {
+	dirStr := "TestReadOnly"
+	os.RemoveAll(dirStr)
+	key := crypto.RandomSymmetric()
+
+	_, err := OpenReadOnly(dirStr, key)
+	assert.Error(t, err)
+
+	f, err := Open(dirStr, key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	data := make([]byte, BlockSize+10)
+	rand.Read(data)
+	tr, err := f.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	f.Close()
+
+	// two read only handles can be open at once
+	f1, err := OpenReadOnly(dirStr, key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f2, err := OpenReadOnly(dirStr, key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, f1.ReadOnly())
+
+	for _, f := range []*Forest{f1, f2} {
+		out, err := f.GetTree(tr.Digest()).ReadAll()
+		assert.NoError(t, err)
+		assert.Equal(t, data, out)
+	}
+
+	// but a writer cannot
+	_, err = OpenWithOptions(dirStr, key, &Options{Timeout: 10 * time.Millisecond})
+	assert.Error(t, err)
+
+	files, err := ioutil.ReadDir(dirStr)
+	assert.NoError(t, err)
+	fileCount := len(files)
+
+	_, err = f1.BuildTree(bytes.NewReader(data[:10]))
+	assert.Equal(t, ErrReadOnly, err)
+	assert.Nil(t, f1.New(tr.Digest(), tr.leaves))
+	assert.Equal(t, ErrReadOnly, f1.SetValue([]byte("bkt"), []byte("k"), []byte("v")))
+	assert.Equal(t, ErrReadOnly, f1.MakeBuckets([]byte("bkt")))
+	_, err = f1.writeLeaf(data, BlockSize)
+	assert.Equal(t, ErrReadOnly, err)
+
+	files, err = ioutil.ReadDir(dirStr)
+	assert.NoError(t, err)
+	assert.Len(t, files, fileCount)
+
+	f1.Close()
+	f2.Close()
 	assert.NoError(t, os.RemoveAll(dirStr))
 }
@@ -0,0 +1,205 @@
+package merkle
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LeafLister is a LeafStore that can list the keys of its leaves. GC can only
+// remove leaves from a LeafStore that is a LeafLister.
+type LeafLister interface {
+	LeafStore
+	Keys(fn func(key []byte) error) error
+}
+
+// GCReport describes what was reclaimed by GC.
+type GCReport struct {
+	Leaves   int
+	Inline   int
+	Branches int
+	// Bytes is approximate, leaves are counted as a full block.
+	Bytes int64
+}
+
+// GC removes every leaf and branch that can't be reached from a tree record.
+// These are left behind when BuildTree fails part way or when a DeleteTree is
+// interrupted. Tree records, so pinned trees, are never removed. The reference
+// counts and stats are also recomputed. Trees can be read while GC runs, but
+// writes wait for it to finish.
+func (f *Forest) GC() (*GCReport, error) {
+	if err := f.writable(); err != nil {
+		return nil, err
+	}
+	f.treeMux.Lock()
+	defer f.treeMux.Unlock()
+	return f.gc()
+}
+
+// gc is GC without the lock.
+func (f *Forest) gc() (*GCReport, error) {
+	r := &GCReport{}
+	live := make(map[string]bool)
+	err := f.meta.Update(func(tx MetaTx) error {
+		*r = GCReport{}
+		counts, err := f.countRefs(tx)
+		if err != nil {
+			return err
+		}
+		for d := range counts {
+			d := d
+			live[string(f.sealDigest(&d))] = true
+		}
+		n, bytes, err := f.sweepBucket(tx, branchBkt, live)
+		r.Branches, r.Bytes = n, r.Bytes+bytes
+		if err != nil {
+			return err
+		}
+		n, bytes, err = f.sweepBucket(tx, inlineBkt, live)
+		r.Inline, r.Bytes = n, r.Bytes+bytes
+		if err != nil {
+			return err
+		}
+		if err = f.rebuildRefs(tx); err != nil {
+			return err
+		}
+		return f.rebuildStats(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.branchCache.purge()
+	f.leafCache.purge()
+
+	if ds, ok := f.leaves.(*DirStore); ok {
+		if err = ds.removeTemp(); err != nil {
+			return r, err
+		}
+	}
+	lister, ok := f.leaves.(LeafLister)
+	if !ok {
+		return r, nil
+	}
+	var dead [][]byte
+	err = lister.Keys(func(key []byte) error {
+		if !live[string(key)] {
+			dead = append(dead, append([]byte(nil), key...))
+		}
+		return nil
+	})
+	if err != nil {
+		return r, err
+	}
+	for _, key := range dead {
+		if err = f.leaves.Delete(key); err != nil {
+			return r, err
+		}
+		r.Leaves++
+		r.Bytes += int64(f.blockSize + overhead)
+	}
+	return r, nil
+}
+
+// sweepBucket deletes every record in a bucket whose key is not live.
+func (f *Forest) sweepBucket(tx MetaTx, bkt []byte, live map[string]bool) (int, int64, error) {
+	b := tx.Bucket(bkt)
+	var dead [][]byte
+	var bytes int64
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if !live[string(k)] {
+			dead = append(dead, append([]byte(nil), k...))
+			bytes += int64(len(k) + len(v))
+		}
+	}
+	for _, k := range dead {
+		if err := b.Delete(k); err != nil {
+			return 0, 0, err
+		}
+	}
+	return len(dead), bytes, nil
+}
+
+// Keys calls fn with the key of every leaf in the DirStore.
+func (s *DirStore) Keys(fn func(key []byte) error) error {
+	return filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != s.dir && !isShardDir(info.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isLeafName(info.Name()) {
+			return nil
+		}
+		key, err := hex.DecodeString(info.Name())
+		if err != nil {
+			return nil
+		}
+		return fn(key)
+	})
+}
+
+// Keys calls fn with the key of every leaf in the memStore.
+func (s *memStore) Keys(fn func(key []byte) error) error {
+	s.RLock()
+	keys := make([][]byte, 0, len(s.leaves))
+	for k := range s.leaves {
+		keys = append(keys, []byte(k))
+	}
+	s.RUnlock()
+	for _, k := range keys {
+		if err := fn(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keys calls fn with the key of every leaf in the PackStore index.
+func (s *PackStore) Keys(fn func(key []byte) error) error {
+	if s.f == nil {
+		return ErrNotAttached
+	}
+	var keys [][]byte
+	err := s.f.meta.View(func(tx MetaTx) error {
+		c := tx.Bucket(packBkt).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := fn(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeTemp removes temp files left behind if a write was interrupted. It
+// must not be called while leaves are being written.
+func (s *DirStore) removeTemp() error {
+	return filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != s.dir && !isShardDir(info.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), tmpPrefix) {
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,120 @@
+package merkle
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type failReader struct {
+	r io.Reader
+}
+
+func (f *failReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.String("test fail")
+	}
+	return n, err
+}
+
+func TestGC(t *testing.T) {
+	dirStr := "TestGC"
+	os.RemoveAll(dirStr)
+	f, err := Open(dirStr, crypto.RandomSymmetric())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	data := make([]byte, BlockSize*4)
+	rand.Read(data)
+	tr, err := f.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// a failed build leaves its leaves behind
+	garbage := make([]byte, BlockSize*3)
+	rand.Read(garbage)
+	_, err = f.BuildTree(&failReader{bytes.NewReader(garbage)})
+	assert.Error(t, err)
+
+	// as does an orphaned branch and a temp file
+	assert.NoError(t, f.writeBranch(newBranch(crypto.GetDigest([]byte("l")), crypto.GetDigest([]byte("r")), 0)))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dirStr, tmpPrefix+"test"), []byte("tmp"), 0666))
+
+	r, err := f.GC()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, r.Leaves)
+	assert.Equal(t, 1, r.Branches)
+	assert.True(t, r.Bytes > 0)
+
+	out, err := f.GetTree(tr.Digest()).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+	assertRefsConsistent(t, f)
+
+	files, err := ioutil.ReadDir(dirStr)
+	assert.NoError(t, err)
+	// the leaves, the Bolt DB and the layoutFile
+	assert.Len(t, files, int(tr.leaves)+2)
+	for _, file := range files {
+		assert.False(t, strings.HasPrefix(file.Name(), tmpPrefix))
+	}
+
+	// nothing left to collect
+	r, err = f.GC()
+	assert.NoError(t, err)
+	assert.Equal(t, GCReport{}, *r)
+
+	f.Close()
+	assert.NoError(t, os.RemoveAll(dirStr))
+}
+
+func TestGCUnreadable(t *testing.T) {
+	f := OpenMemory(crypto.RandomSymmetric())
+	store := f.leaves.(*memStore)
+	data := make([]byte, BlockSize*4)
+	rand.Read(data)
+	tr, err := f.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	leaves := len(store.leaves)
+
+	// a corrupt branch would make everything below it look unreachable
+	f.meta.Update(func(tx MetaTx) error {
+		br := f.readBranchTx(tx, tr.Digest())
+		return tx.Bucket(branchBkt).Put(f.sealDigest(br.left), []byte("garbage"))
+	})
+	_, err = f.GC()
+	assert.Equal(t, ErrUnreadable, err)
+	assert.Len(t, store.leaves, leaves)
+
+	// as would a tree record under a key that can't be decrypted
+	key := crypto.RandomSymmetric()
+	f.meta.Update(func(tx MetaTx) error {
+		br := f.readBranchTx(tx, tr.Digest())
+		tx.Bucket(branchBkt).Put(f.sealDigest(br.left), f.key().Seal(make([]byte, 10), nil))
+		return tx.Bucket(treeBkt).Put(key.Seal(tr.Digest().Slice(), zeroNonce)[crypto.NonceLength:], []byte("garbage"))
+	})
+	_, err = f.GC()
+	assert.Equal(t, ErrUnreadable, err)
+	assert.Len(t, store.leaves, leaves)
+
+	r, err := f.Repair(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, r.Problems, 2)
+	_, err = f.GC()
+	assert.NoError(t, err)
+	assertRefsConsistent(t, f)
+}
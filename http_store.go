@@ -0,0 +1,189 @@
+package merkle
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/dist-ribut-us/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// HTTPStore is a LeafStore that keeps leaves on a remote blob store. The store
+// does not need to be trusted; it only ever sees encrypted, padded leaves
+// named by their sealed digest. It speaks a simple S3 style protocol where
+// each leaf is a resource under the base URL that is written with PUT, read
+// with GET, checked with HEAD and removed with DELETE.
+type HTTPStore struct {
+	base   string
+	client *http.Client
+	// maxLeaf is the length of an encrypted leaf, no body longer than this
+	// is read.
+	maxLeaf int64
+}
+
+// ErrRemoteStore is returned when the remote blob store gives an unexpected
+// response.
+const ErrRemoteStore = errors.String("Unexpected response from remote store")
+
+// ErrLeafTooLarge is returned when the remote blob store returns more than a
+// leaf.
+const ErrLeafTooLarge = errors.String("Leaf from remote store is too large")
+
+// NewHTTPStore returns an HTTPStore that keeps leaves under the base URL. If
+// client is nil, http.DefaultClient is used.
+func NewHTTPStore(base string, client *http.Client) *HTTPStore {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPStore{
+		base:    strings.TrimRight(base, "/"),
+		client:  client,
+		maxLeaf: BlockSize + overhead,
+	}
+}
+
+// attach sets the leaf length from the Forest's block size.
+func (s *HTTPStore) attach(f *Forest) error {
+	s.maxLeaf = int64(f.blockSize + overhead)
+	return nil
+}
+
+// closeBody reads what is left of a response body, up to the length of a leaf,
+// so the connection can be reused, and closes it.
+func (s *HTTPStore) closeBody(resp *http.Response) {
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, s.maxLeaf))
+	resp.Body.Close()
+}
+
+func (s *HTTPStore) do(method string, key, body []byte) (*http.Response, error) {
+	url := s.base + "/" + hex.EncodeToString(key)
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return s.client.Do(req)
+}
+
+// Put uploads a leaf.
+func (s *HTTPStore) Put(key, leaf []byte) error {
+	resp, err := s.do(http.MethodPut, key, leaf)
+	if err != nil {
+		return err
+	}
+	s.closeBody(resp)
+	if resp.StatusCode/100 != 2 {
+		return ErrRemoteStore
+	}
+	return nil
+}
+
+// Get downloads a leaf. A body longer than a leaf is not read, ErrLeafTooLarge
+// is returned.
+func (s *HTTPStore) Get(key []byte) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer s.closeBody(resp)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrLeafNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, ErrRemoteStore
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, s.maxLeaf+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > s.maxLeaf {
+		return nil, ErrLeafTooLarge
+	}
+	return b, nil
+}
+
+// Has checks if the remote store has a leaf.
+func (s *HTTPStore) Has(key []byte) (bool, error) {
+	resp, err := s.do(http.MethodHead, key, nil)
+	if err != nil {
+		return false, err
+	}
+	s.closeBody(resp)
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return false, ErrRemoteStore
+	}
+	return true, nil
+}
+
+// Delete removes a leaf from the remote store. Deleting a leaf that does not
+// exist is not an error.
+func (s *HTTPStore) Delete(key []byte) error {
+	resp, err := s.do(http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	s.closeBody(resp)
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return ErrRemoteStore
+	}
+	return nil
+}
+
+// BlobServer is a minimal blob store that speaks the protocol used by
+// HTTPStore. It keeps everything in memory and is intended as a local stand in
+// for a remote store in tests.
+type BlobServer struct {
+	blobs *memStore
+}
+
+// NewBlobServer returns an empty BlobServer.
+func NewBlobServer() *BlobServer {
+	return &BlobServer{
+		blobs: newMemStore(),
+	}
+}
+
+// Len returns the number of blobs held by the server.
+func (s *BlobServer) Len() int {
+	s.blobs.RLock()
+	defer s.blobs.RUnlock()
+	return len(s.blobs.leaves)
+}
+
+// ServeHTTP implements http.Handler.
+func (s *BlobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, err := hex.DecodeString(strings.TrimPrefix(r.URL.Path, "/"))
+	if err != nil || len(key) == 0 {
+		http.Error(w, "bad key", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.blobs.Put(key, b)
+	case http.MethodGet:
+		b, err := s.blobs.Get(key)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+	case http.MethodHead:
+		if ok, _ := s.blobs.Has(key); !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case http.MethodDelete:
+		s.blobs.Delete(key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,73 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestHTTPStore(t *testing.T) {
+	dirStr := "TestHTTPStore"
+	os.RemoveAll(dirStr)
+
+	srv := NewBlobServer()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	f, err := OpenWithStore(dirStr, crypto.RandomSymmetric(), NewHTTPStore(ts.URL, nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	data := make([]byte, BlockSize*2+100)
+	rand.Read(data)
+	tr, err := f.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int(tr.leaves), srv.Len())
+
+	out, err := f.GetTree(tr.Digest()).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+
+	// only the Bolt DB should be local
+	files, err := ioutil.ReadDir(dirStr)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	store := f.leaves
+	key := f.sealDigest(tr.Digest())
+	ok, err := store.Has(key)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	_, err = store.Get(key)
+	assert.Equal(t, ErrLeafNotFound, err)
+
+	assert.NoError(t, store.Put(key, []byte("test")))
+	ok, err = store.Has(key)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, store.Delete(key))
+	assert.NoError(t, store.Delete(key))
+	ok, err = store.Has(key)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// a body longer than a leaf is refused
+	assert.NoError(t, store.Put(key, make([]byte, BlockSize+overhead+1)))
+	_, err = store.Get(key)
+	assert.Equal(t, ErrLeafTooLarge, err)
+	assert.NoError(t, store.Put(key, make([]byte, BlockSize+overhead)))
+	b, err := store.Get(key)
+	assert.NoError(t, err)
+	assert.Len(t, b, BlockSize+overhead)
+
+	f.Close()
+	assert.NoError(t, os.RemoveAll(dirStr))
+}
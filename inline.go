@@ -0,0 +1,56 @@
+package merkle
+
+import (
+	"github.com/dist-ribut-us/crypto"
+)
+
+// InlineSize is the largest tree that is stored inline. A tree with a single
+// leaf no longer than InlineSize is kept in an encrypted bucket in the Bolt DB
+// instead of the LeafStore so that small resources do not cost a full block.
+// It is chosen so that the encrypted leaf fits in 4096 bytes.
+const InlineSize = 4096 - overhead
+
+// minInlineClass is the smallest size class for inline leaves. Each class is
+// double the previous so that the size of an inline leaf leaks very little.
+const minInlineClass = 128
+
+var inlineBkt = []byte("i")
+
+// inlineClass returns the length an inline leaf of length l is padded to. The
+// length after encryption is always a power of 2.
+func inlineClass(l int) int {
+	c := minInlineClass
+	for c-overhead < l {
+		c *= 2
+	}
+	return c - overhead
+}
+
+func (f *Forest) writeInline(b []byte, l int) (*crypto.Digest, error) {
+	if err := f.writable(); err != nil {
+		return nil, err
+	}
+	d := crypto.GetDigest(b[:l])
+	padded := make([]byte, inlineClass(l))
+	copy(padded, b[:l])
+	key := f.sealDigest(d)
+	val := f.key().Seal(padded, nil)
+	return d, f.meta.Update(func(tx MetaTx) error {
+		return tx.Bucket(inlineBkt).Put(key, val)
+	})
+}
+
+// readInline returns the encrypted inline leaf or nil if it is not stored
+// inline.
+func (f *Forest) readInline(cd []byte) []byte {
+	var b []byte
+	f.meta.View(func(tx MetaTx) error {
+		if bkt := tx.Bucket(inlineBkt); bkt != nil {
+			if v := bkt.Get(cd); v != nil {
+				b = append([]byte(nil), v...)
+			}
+		}
+		return nil
+	})
+	return b
+}
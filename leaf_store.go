@@ -0,0 +1,583 @@
+package merkle
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// LeafStore is where a Forest keeps its leaves. Leaves are keyed by their
+// sealed digest and the value is the encrypted, padded leaf, so a LeafStore
+// never handles plaintext data or digests. If Get finds a leaf but can't read
+// all of it, it should return ErrCorrupt so the tree is repaired.
+type LeafStore interface {
+	Put(key, leaf []byte) error
+	Get(key []byte) ([]byte, error)
+	Has(key []byte) (bool, error)
+	Delete(key []byte) error
+}
+
+// Durability controls when leaves are flushed to disk.
+type Durability byte
+
+const (
+	// SyncNone leaves flushing to the operating system.
+	SyncNone Durability = iota
+	// SyncLeaf flushes every leaf, and the directory holding it, as soon as it
+	// is written.
+	SyncLeaf
+	// SyncTree flushes all the leaves written for a tree, and the directories
+	// holding them, once before the tree is saved.
+	SyncTree
+)
+
+// SyncStore is a LeafStore that can make writes durable. If a Forest uses a
+// SyncStore, it will pass on its Durability and call Sync before saving a tree
+// when the Durability is SyncTree. SyncKeys flushes the given leaves to disk
+// whatever the Durability is, Rekey uses it before deleting the old copies.
+type SyncStore interface {
+	LeafStore
+	SetDurability(d Durability)
+	Sync() error
+	SyncKeys(keys [][]byte) error
+}
+
+// forestStore is a LeafStore that needs something from the Forest, like the
+// PackStore, which keeps its index there, or the HTTPStore, which needs the
+// block size. The Forest calls attach when it is opened.
+type forestStore interface {
+	attach(f *Forest) error
+}
+
+// ErrLeafNotFound is returned by a LeafStore when asked for a leaf it does not
+// have.
+const ErrLeafNotFound = errors.String("Leaf not found")
+
+// DirStore is the default LeafStore. Each leaf is saved as a file and the file
+// name is the hex encoding of the key. By default all the leaves are in one
+// directory, but a very large number of files in a single directory is slow on
+// most file systems, so the leaves can be sharded into levels of sub
+// directories named by the leading hex pairs of the file name.
+//
+// Leaves are written to a temp file that is renamed once it is complete, so a
+// crash will never leave a partial leaf. With SyncTree the temp files are kept
+// until Sync, which flushes them all before they are renamed.
+type DirStore struct {
+	dir        string
+	levels     int
+	fileMode   os.FileMode
+	dirMode    os.FileMode
+	durability Durability
+	mux        sync.Mutex
+	syncMux    sync.Mutex
+	pending    map[string]string
+	migrated   bool
+	unmarked   bool
+}
+
+// MaxShardLevels is the deepest sharding a DirStore supports. Each level has
+// 256 sub directories.
+const MaxShardLevels = 4
+
+// leafNameLen is the length of a leaf file name.
+const leafNameLen = 2 * (crypto.DigestLength + crypto.Overhead)
+
+// NewDirStore returns a DirStore that saves leaves in dir without sharding.
+// The directory must already exist.
+func NewDirStore(dir string) *DirStore {
+	return NewShardedDirStore(dir, 0)
+}
+
+// NewShardedDirStore returns a DirStore that saves leaves in dir using levels
+// of sub directories. Leaves saved with a different number of levels can still
+// be read, use Migrate to move them into the current layout.
+func NewShardedDirStore(dir string, levels int) *DirStore {
+	if levels < 0 {
+		levels = 0
+	} else if levels > MaxShardLevels {
+		levels = MaxShardLevels
+	}
+	return &DirStore{
+		dir:      dir,
+		levels:   levels,
+		fileMode: 0666,
+		dirMode:  0777,
+		pending:  make(map[string]string),
+		migrated: readLayout(dir) == levels,
+	}
+}
+
+// layoutFile records the number of levels every leaf in the directory is saved
+// with. It is written by Migrate, or when a Forest is created in a directory
+// without leaves, and removed as soon as a leaf is saved with a different
+// number of levels. While it matches, a DirStore does not look for
+// leaves in the other layouts.
+const layoutFile = ".layout"
+
+// readLayout returns the number of levels in the layoutFile, or -1 if there
+// isn't one.
+func readLayout(dir string) int {
+	b, err := ioutil.ReadFile(filepath.Join(dir, layoutFile))
+	if err != nil {
+		return -1
+	}
+	levels, err := strconv.Atoi(string(b))
+	if err != nil {
+		return -1
+	}
+	return levels
+}
+
+// markMigrated writes the layoutFile for the current layout. It is only safe
+// to call once every leaf is in the current layout.
+func (s *DirStore) markMigrated() error {
+	file, err := createTemp(s.dir, s.fileMode)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(strconv.Itoa(s.levels))
+	if err == nil {
+		err = file.Sync()
+	}
+	if cErr := file.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(s.dir, layoutFile))
+	}
+	if err == nil {
+		err = syncPath(s.dir)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	s.mux.Lock()
+	s.migrated = true
+	s.mux.Unlock()
+	return nil
+}
+
+// markIfEmpty writes the layoutFile if there are no leaves or shard
+// directories in the directory, so a new DirStore never looks for leaves in
+// the other layouts.
+func (s *DirStore) markIfEmpty() error {
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if isLeafName(name) || isShardDir(name) {
+			return nil
+		}
+	}
+	return s.markMigrated()
+}
+
+// unmark removes a layoutFile left by a DirStore with a different number of
+// levels before the first leaf is saved, so that DirStore will look for the
+// leaves saved by this one.
+func (s *DirStore) unmark() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.migrated || s.unmarked {
+		return nil
+	}
+	err := os.Remove(filepath.Join(s.dir, layoutFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.unmarked = true
+	return nil
+}
+
+func (s *DirStore) path(key []byte) string {
+	return s.levelPath(hex.EncodeToString(key), s.levels)
+}
+
+func (s *DirStore) levelPath(name string, levels int) string {
+	p := s.dir
+	for i := 0; i < levels; i++ {
+		p = filepath.Join(p, name[i*2:i*2+2])
+	}
+	return filepath.Join(p, name)
+}
+
+// find returns the path of a leaf, which is the temp file if it is waiting for
+// a Sync, checking the other layouts if the leaf is not in the current one and
+// Migrate has not finished. The current layout is checked a second time in
+// case a Migrate moved the file while the others were checked.
+func (s *DirStore) find(key []byte) (string, bool) {
+	name := hex.EncodeToString(key)
+	p := s.levelPath(name, s.levels)
+	// a pending leaf is only removed from pending once it is renamed
+	s.mux.Lock()
+	tmp, pending := s.pending[p]
+	migrated := s.migrated
+	s.mux.Unlock()
+	if pending {
+		return tmp, true
+	}
+	if fileExists(p) {
+		return p, true
+	}
+	if migrated {
+		return p, false
+	}
+	for l := 0; l <= MaxShardLevels; l++ {
+		if l == s.levels {
+			continue
+		}
+		if lp := s.levelPath(name, l); fileExists(lp) {
+			return lp, true
+		}
+	}
+	return p, fileExists(p)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// tmpPrefix is the prefix of temp files used while writing a leaf.
+const tmpPrefix = ".tmp-"
+
+// Put saves a leaf to a file. With SyncLeaf, the temp file is flushed before
+// it is renamed. With SyncTree, it is left for Sync to flush and rename. Leaves
+// are content addressed, so a leaf that is already saved is not written again.
+func (s *DirStore) Put(key, leaf []byte) error {
+	if _, ok := s.find(key); ok {
+		return nil
+	}
+	if err := s.unmark(); err != nil {
+		return err
+	}
+	s.mux.Lock()
+	durability := s.durability
+	left := len(s.pending)
+	s.mux.Unlock()
+	if durability != SyncTree && left > 0 {
+		// left from before the Durability was changed
+		if err := s.Sync(); err != nil {
+			return err
+		}
+	}
+	p := s.path(key)
+	dir := filepath.Dir(p)
+	file, err := s.createIn(dir)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(leaf)
+	if err == nil && durability == SyncLeaf {
+		err = file.Sync()
+	}
+	if cErr := file.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil && durability == SyncTree {
+		s.mux.Lock()
+		s.pending[p] = file.Name()
+		s.mux.Unlock()
+		return nil
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), p)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if durability == SyncLeaf {
+		return syncPath(dir)
+	}
+	return nil
+}
+
+// createTries is how many times createIn tries to create a temp file.
+const createTries = 5
+
+// createIn creates a temp file in a shard directory, making the directory if
+// it is needed. Migrate removes empty shard directories, so if the directory,
+// or one of its parents, is removed before the file is created it is made
+// again.
+func (s *DirStore) createIn(dir string) (*os.File, error) {
+	for i := 1; ; i++ {
+		var file *os.File
+		var err error
+		if s.levels > 0 {
+			err = os.MkdirAll(dir, s.dirMode)
+		}
+		if err == nil {
+			file, err = createTemp(dir, s.fileMode)
+		}
+		if err == nil || !os.IsNotExist(err) || i == createTries {
+			return file, err
+		}
+	}
+}
+
+func createTemp(dir string, mode os.FileMode) (*os.File, error) {
+	r := make([]byte, 8)
+	if _, err := rand.Read(r); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, tmpPrefix+hex.EncodeToString(r))
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+}
+
+// SetDurability sets when leaves are flushed to disk.
+func (s *DirStore) SetDurability(d Durability) {
+	s.mux.Lock()
+	s.durability = d
+	s.mux.Unlock()
+}
+
+// Sync flushes the temp files of the leaves written with SyncTree since the
+// last Sync, renames them and then flushes the directories holding them. It
+// only has work to do if the Durability is SyncTree. The leaves stay pending
+// until they are renamed, so they can still be read while Sync runs.
+func (s *DirStore) Sync() error {
+	s.syncMux.Lock()
+	defer s.syncMux.Unlock()
+	s.mux.Lock()
+	pending := make(map[string]string, len(s.pending))
+	for p, tmp := range s.pending {
+		pending[p] = tmp
+	}
+	s.mux.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	for _, tmp := range pending {
+		if err := syncPath(tmp); err != nil {
+			return err
+		}
+	}
+	dirs := make(map[string]bool)
+	for p, tmp := range pending {
+		if err := os.Rename(tmp, p); err != nil {
+			return err
+		}
+		s.mux.Lock()
+		delete(s.pending, p)
+		s.mux.Unlock()
+		dirs[filepath.Dir(p)] = true
+	}
+	for dir := range dirs {
+		if err := syncPath(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SyncKeys flushes the files holding the leaves and their directories to disk.
+// Keys that are not in the DirStore are skipped. Leaves waiting for a Sync are
+// flushed by calling Sync first.
+func (s *DirStore) SyncKeys(keys [][]byte) error {
+	if err := s.Sync(); err != nil {
+		return err
+	}
+	dirs := make(map[string]bool)
+	for _, key := range keys {
+		path, ok := s.find(key)
+		if !ok {
+			continue
+		}
+		if err := syncPath(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		dirs[filepath.Dir(path)] = true
+	}
+	for dir := range dirs {
+		if err := syncPath(dir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if cErr := file.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// Get reads a leaf from it's file.
+func (s *DirStore) Get(key []byte) ([]byte, error) {
+	p, ok := s.find(key)
+	if !ok {
+		return nil, ErrLeafNotFound
+	}
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		// moved by Migrate or renamed by Sync between find and ReadFile
+		b, err = ioutil.ReadFile(s.path(key))
+	}
+	if os.IsNotExist(err) {
+		return nil, ErrLeafNotFound
+	}
+	return b, err
+}
+
+// Has checks if the file for a leaf exists.
+func (s *DirStore) Has(key []byte) (bool, error) {
+	_, ok := s.find(key)
+	return ok, nil
+}
+
+// Delete removes the file for a leaf from every layout. Deleting a leaf that
+// does not exist is not an error.
+func (s *DirStore) Delete(key []byte) error {
+	// a pending leaf can't be deleted while Sync is renaming it
+	s.syncMux.Lock()
+	defer s.syncMux.Unlock()
+	s.mux.Lock()
+	p := s.path(key)
+	tmp, ok := s.pending[p]
+	delete(s.pending, p)
+	s.mux.Unlock()
+	if ok {
+		if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	name := hex.EncodeToString(key)
+	for l := 0; l <= MaxShardLevels; l++ {
+		err := os.Remove(s.levelPath(name, l))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Migrate moves every leaf in the directory that is not in the current layout
+// into it. Each leaf is moved with a rename, so the DirStore can still be read
+// during a migration and if a migration is interrupted, calling Migrate again
+// will finish it. Shard directories left empty are removed. Once it is done,
+// it is recorded in the directory so the DirStore stops looking for leaves in
+// the other layouts.
+func (s *DirStore) Migrate() error {
+	var dirs []string
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// a temp file renamed or a leaf deleted while walking
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if info.IsDir() {
+			if path != s.dir {
+				if !isShardDir(name) {
+					return filepath.SkipDir
+				}
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		if !isLeafName(name) {
+			return nil
+		}
+		to := s.levelPath(name, s.levels)
+		if to == path {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(to), s.dirMode); err != nil {
+			return err
+		}
+		if err := os.Rename(path, to); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// deepest first so parents are empty when they are reached
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+	return s.markMigrated()
+}
+
+func isShardDir(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+func isLeafName(name string) bool {
+	if len(name) != leafNameLen {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// memStore is a LeafStore that only holds leaves in memory.
+type memStore struct {
+	sync.RWMutex
+	leaves map[string][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		leaves: make(map[string][]byte),
+	}
+}
+
+func (s *memStore) Put(key, leaf []byte) error {
+	s.Lock()
+	s.leaves[string(key)] = append([]byte(nil), leaf...)
+	s.Unlock()
+	return nil
+}
+
+func (s *memStore) Get(key []byte) ([]byte, error) {
+	s.RLock()
+	b, ok := s.leaves[string(key)]
+	s.RUnlock()
+	if !ok {
+		return nil, ErrLeafNotFound
+	}
+	return append([]byte(nil), b...), nil
+}
+
+func (s *memStore) Has(key []byte) (bool, error) {
+	s.RLock()
+	_, ok := s.leaves[string(key)]
+	s.RUnlock()
+	return ok, nil
+}
+
+func (s *memStore) Delete(key []byte) error {
+	s.Lock()
+	delete(s.leaves, string(key))
+	s.Unlock()
+	return nil
+}
@@ -0,0 +1,289 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type countingStore struct {
+	LeafStore
+	puts, gets int
+}
+
+func (c *countingStore) Put(key, leaf []byte) error {
+	c.puts++
+	return c.LeafStore.Put(key, leaf)
+}
+
+func (c *countingStore) Get(key []byte) ([]byte, error) {
+	c.gets++
+	return c.LeafStore.Get(key)
+}
+
+func TestOpenWithStore(t *testing.T) {
+	dirStr := "TestOpenWithStore"
+	leafDir := "TestOpenWithStoreLeaves"
+	os.RemoveAll(dirStr)
+	os.RemoveAll(leafDir)
+	assert.NoError(t, os.MkdirAll(leafDir, 0777))
+	key := crypto.RandomSymmetric()
+
+	store := &countingStore{LeafStore: NewDirStore(leafDir)}
+	f, err := OpenWithStore(dirStr, key, store)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	data := make([]byte, BlockSize*3)
+	rand.Read(data)
+	tr, err := f.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int(tr.leaves), store.puts)
+
+	out, err := tr.ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+	assert.True(t, store.gets > 0)
+
+	_, err = store.Get([]byte("not a leaf"))
+	assert.Equal(t, ErrLeafNotFound, err)
+
+	f.Close()
+	assert.NoError(t, os.RemoveAll(dirStr))
+	assert.NoError(t, os.RemoveAll(leafDir))
+}
+
+func TestShardedDirStore(t *testing.T) {
+	dirStr := "TestShardedDirStore"
+	os.RemoveAll(dirStr)
+	key := crypto.RandomSymmetric()
+
+	f, err := Open(dirStr, key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// a new Forest has nothing to migrate
+	assert.Equal(t, 0, readLayout(dirStr))
+	assert.True(t, f.leaves.(*DirStore).migrated)
+	data := make([]byte, BlockSize*4)
+	rand.Read(data)
+	tr, err := f.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	f.Close()
+
+	store := NewShardedDirStore(dirStr, 2)
+	f, err = OpenWithStore(dirStr, key, store)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// flat leaves can still be read before the migration
+	out, err := f.GetTree(tr.Digest()).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+
+	assert.NoError(t, store.Migrate())
+	// running it again should not change anything
+	assert.NoError(t, store.Migrate())
+
+	leaves := 0
+	err = filepath.Walk(dirStr, func(path string, info os.FileInfo, err error) error {
+		if info.IsDir() || !isLeafName(info.Name()) {
+			return nil
+		}
+		leaves++
+		rel, _ := filepath.Rel(dirStr, path)
+		assert.Equal(t, 3, len(strings.Split(rel, string(filepath.Separator))))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int(tr.leaves), leaves)
+
+	out, err = f.GetTree(tr.Digest()).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+
+	// and back to a flat layout
+	f.Close()
+	store = NewDirStore(dirStr)
+	f, err = OpenWithStore(dirStr, key, store)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, store.Migrate())
+	files, err := ioutil.ReadDir(dirStr)
+	assert.NoError(t, err)
+	// the leaves, the Bolt DB and the layoutFile
+	assert.Len(t, files, leaves+2)
+	out, err = f.GetTree(tr.Digest()).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+
+	f.Close()
+	assert.NoError(t, os.RemoveAll(dirStr))
+}
+
+func TestDirStoreLayout(t *testing.T) {
+	dirStr := "TestDirStoreLayout"
+	os.RemoveAll(dirStr)
+	assert.NoError(t, os.MkdirAll(dirStr, 0777))
+	key := make([]byte, leafNameLen/2)
+	other := make([]byte, leafNameLen/2)
+	rand.Read(key)
+	rand.Read(other)
+
+	flat := NewDirStore(dirStr)
+	assert.NoError(t, flat.Put(key, []byte("leaf")))
+	sharded := NewShardedDirStore(dirStr, 1)
+	ok, _ := sharded.Has(key)
+	assert.True(t, ok)
+	// a directory with leaves in it is not marked until Migrate is done
+	assert.NoError(t, sharded.markIfEmpty())
+	assert.Equal(t, -1, readLayout(dirStr))
+
+	// once migrated, the old layout is not checked
+	assert.NoError(t, sharded.Migrate())
+	assert.Equal(t, 1, readLayout(dirStr))
+	name := hex.EncodeToString(key)
+	assert.NoError(t, os.Rename(sharded.levelPath(name, 1), sharded.levelPath(name, 0)))
+	ok, _ = sharded.Has(key)
+	assert.False(t, ok)
+	ok, _ = NewShardedDirStore(dirStr, 1).Has(key)
+	assert.False(t, ok)
+
+	// a store with a different layout removes the layoutFile when it writes
+	assert.NoError(t, NewShardedDirStore(dirStr, 2).Put(other, []byte("leaf")))
+	assert.Equal(t, -1, readLayout(dirStr))
+	sharded = NewShardedDirStore(dirStr, 1)
+	ok, _ = sharded.Has(key)
+	assert.True(t, ok)
+	ok, _ = sharded.Has(other)
+	assert.True(t, ok)
+
+	assert.NoError(t, os.RemoveAll(dirStr))
+}
+
+func TestDirStoreMigratePut(t *testing.T) {
+	dirStr := "TestDirStoreMigratePut"
+	os.RemoveAll(dirStr)
+	assert.NoError(t, os.MkdirAll(dirStr, 0777))
+	store := NewShardedDirStore(dirStr, 2)
+
+	// Put and Migrate race on the shard directories
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, store.Migrate())
+		}
+		close(done)
+	}()
+	var keys [][]byte
+	for i := 0; i < 200; i++ {
+		key := make([]byte, leafNameLen/2)
+		rand.Read(key)
+		keys = append(keys, key)
+		assert.NoError(t, store.Put(key, key))
+	}
+	<-done
+	for _, key := range keys {
+		leaf, err := store.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, key, leaf)
+	}
+	assert.NoError(t, os.RemoveAll(dirStr))
+}
+
+func TestDirStoreSyncTree(t *testing.T) {
+	dirStr := "TestDirStoreSyncTree"
+	os.RemoveAll(dirStr)
+	assert.NoError(t, os.MkdirAll(dirStr, 0777))
+	store := NewShardedDirStore(dirStr, 1)
+	store.SetDurability(SyncTree)
+	key := make([]byte, leafNameLen/2)
+	other := make([]byte, leafNameLen/2)
+	rand.Read(key)
+	rand.Read(other)
+
+	// the leaf stays in its temp file until Sync, but it can be read
+	assert.NoError(t, store.Put(key, []byte("leaf")))
+	assert.NoError(t, store.Put(other, []byte("other")))
+	assert.False(t, fileExists(store.path(key)))
+	assert.Len(t, store.pending, 2)
+	b, err := store.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("leaf"), b)
+	ok, _ := store.Has(key)
+	assert.True(t, ok)
+	assert.NoError(t, store.Put(key, []byte("again")))
+
+	// a pending leaf that is deleted is never renamed
+	tmp := store.pending[store.path(other)]
+	assert.NoError(t, store.Delete(other))
+	assert.False(t, fileExists(tmp))
+
+	assert.NoError(t, store.Sync())
+	assert.Len(t, store.pending, 0)
+	assert.True(t, fileExists(store.path(key)))
+	assert.False(t, fileExists(store.path(other)))
+	b, err = store.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("leaf"), b)
+	assert.NoError(t, os.RemoveAll(dirStr))
+}
+
+func TestDurability(t *testing.T) {
+	dirStr := "TestDurability"
+	os.RemoveAll(dirStr)
+	key := crypto.RandomSymmetric()
+
+	f, err := Open(dirStr, key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	store := f.leaves.(*DirStore)
+
+	for _, d := range []Durability{SyncNone, SyncLeaf, SyncTree} {
+		f.SetDurability(d)
+		data := make([]byte, BlockSize*2+10)
+		rand.Read(data)
+		tr, err := f.BuildTree(bytes.NewReader(data))
+		if !assert.NoError(t, err) {
+			return
+		}
+		// SyncTree should have flushed everything before saving the tree
+		assert.Len(t, store.pending, 0)
+
+		out, err := f.GetTree(tr.Digest()).ReadAll()
+		assert.NoError(t, err)
+		assert.Equal(t, data, out)
+	}
+
+	files, err := ioutil.ReadDir(dirStr)
+	assert.NoError(t, err)
+	for _, file := range files {
+		assert.False(t, strings.HasPrefix(file.Name(), tmpPrefix))
+	}
+
+	// a leaf that is already saved is not written again
+	k := []byte("leaf")
+	assert.NoError(t, store.Put(k, []byte("first")))
+	assert.NoError(t, store.Put(k, []byte("second")))
+	b, err := store.Get(k)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first"), b)
+
+	f.Close()
+	assert.NoError(t, os.RemoveAll(dirStr))
+}
@@ -0,0 +1,330 @@
+package merkle
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/dist-ribut-us/errors"
+	"sort"
+	"sync"
+)
+
+// MetaStore holds the structural information of a Forest: branches, tree
+// records and values. It follows the transaction model of Bolt. The records
+// are encrypted, but not everything a MetaStore sees is. Bucket names,
+// including the ones passed to SetValue, the keys in the config bucket, the
+// key used to check the Forest key and the PackStore segment numbers are in
+// plain text. Digests and SetValue keys are sealed without a nonce, so the
+// same key is always stored the same way. The number and length of the
+// records are not hidden.
+//
+// A Forest will not call a LeafStore method while it is inside a transaction.
+type MetaStore interface {
+	View(fn func(tx MetaTx) error) error
+	Update(fn func(tx MetaTx) error) error
+	Close() error
+}
+
+// MetaTx is a transaction on a MetaStore. If the function passed to Update
+// returns an error, none of the writes in the transaction should be kept.
+type MetaTx interface {
+	// Bucket returns nil if the bucket does not exist.
+	Bucket(name []byte) MetaBucket
+	CreateBucketIfNotExists(name []byte) (MetaBucket, error)
+}
+
+// MetaBucketLister can optionally be implemented by a MetaTx. Rekey needs it to
+// find the buckets made with SetValue and MakeBuckets.
+type MetaBucketLister interface {
+	// Buckets returns the name of every bucket.
+	Buckets() [][]byte
+}
+
+// MetaBucket is a sorted key value store within a MetaTx.
+type MetaBucket interface {
+	// Get returns nil if the key does not exist.
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	Cursor() MetaCursor
+}
+
+// MetaCursor iterates over a MetaBucket in key order. The bucket should not be
+// changed while a cursor is in use. When the end is reached, the key is nil.
+type MetaCursor interface {
+	First() (key, value []byte)
+	Seek(seek []byte) (key, value []byte)
+	Next() (key, value []byte)
+}
+
+// BoltMeta is the default MetaStore. It keeps everything in a Bolt DB.
+type BoltMeta struct {
+	db    *bolt.DB
+	root  []byte
+	owned bool
+}
+
+// NewBoltMeta returns a MetaStore using a Bolt DB that is shared with the rest
+// of an application. If root is not nil, all of the Forest's buckets are kept
+// inside of the root bucket so they can't collide with other buckets. Closing
+// the Forest does not close the DB.
+func NewBoltMeta(db *bolt.DB, root []byte) *BoltMeta {
+	return &BoltMeta{
+		db:   db,
+		root: root,
+	}
+}
+
+// View runs fn in a read only transaction.
+func (m *BoltMeta) View(fn func(tx MetaTx) error) error {
+	return m.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx, m.root})
+	})
+}
+
+// Update runs fn in a read write transaction.
+func (m *BoltMeta) Update(fn func(tx MetaTx) error) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx, m.root})
+	})
+}
+
+// Close closes the DB if it was opened by the Forest.
+func (m *BoltMeta) Close() error {
+	if !m.owned {
+		return nil
+	}
+	return m.db.Close()
+}
+
+type boltTx struct {
+	tx   *bolt.Tx
+	root []byte
+}
+
+func (t boltTx) Bucket(name []byte) MetaBucket {
+	var b *bolt.Bucket
+	if t.root == nil {
+		b = t.tx.Bucket(name)
+	} else if r := t.tx.Bucket(t.root); r != nil {
+		b = r.Bucket(name)
+	}
+	if b == nil {
+		return nil
+	}
+	return boltBucket{b}
+}
+
+func (t boltTx) CreateBucketIfNotExists(name []byte) (MetaBucket, error) {
+	var b *bolt.Bucket
+	var err error
+	if t.root == nil {
+		b, err = t.tx.CreateBucketIfNotExists(name)
+	} else if b, err = t.tx.CreateBucketIfNotExists(t.root); err == nil {
+		b, err = b.CreateBucketIfNotExists(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{b}, nil
+}
+
+func (t boltTx) Buckets() [][]byte {
+	var names [][]byte
+	add := func(name []byte, _ *bolt.Bucket) error {
+		names = append(names, append([]byte(nil), name...))
+		return nil
+	}
+	if t.root == nil {
+		t.tx.ForEach(add)
+	} else if r := t.tx.Bucket(t.root); r != nil {
+		r.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return add(k, nil)
+			}
+			return nil
+		})
+	}
+	return names
+}
+
+type boltBucket struct {
+	*bolt.Bucket
+}
+
+func (b boltBucket) Cursor() MetaCursor { return b.Bucket.Cursor() }
+
+// ErrTxNotWritable is returned when trying to write during a View transaction.
+const ErrTxNotWritable = errors.String("Transaction is not writable")
+
+// NewMemoryMeta returns a MetaStore that is only held in memory.
+func NewMemoryMeta() MetaStore {
+	return newMemMeta()
+}
+
+// memMeta is a MetaStore that is only held in memory. Writes in an Update are
+// applied immediately and undone if the Update returns an error.
+type memMeta struct {
+	sync.RWMutex
+	bkts map[string]*memBucket
+}
+
+func newMemMeta() *memMeta {
+	return &memMeta{
+		bkts: make(map[string]*memBucket),
+	}
+}
+
+func (m *memMeta) View(fn func(tx MetaTx) error) error {
+	m.RLock()
+	defer m.RUnlock()
+	return fn(&memTx{m: m})
+}
+
+func (m *memMeta) Update(fn func(tx MetaTx) error) error {
+	m.Lock()
+	defer m.Unlock()
+	tx := &memTx{
+		m:        m,
+		writable: true,
+	}
+	err := fn(tx)
+	if err != nil {
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			tx.undo[i]()
+		}
+	}
+	return err
+}
+
+func (m *memMeta) Close() error { return nil }
+
+type memTx struct {
+	m        *memMeta
+	writable bool
+	undo     []func()
+}
+
+func (t *memTx) Bucket(name []byte) MetaBucket {
+	b, ok := t.m.bkts[string(name)]
+	if !ok {
+		return nil
+	}
+	return &memTxBucket{b: b, tx: t}
+}
+
+func (t *memTx) CreateBucketIfNotExists(name []byte) (MetaBucket, error) {
+	if b := t.Bucket(name); b != nil {
+		return b, nil
+	}
+	if !t.writable {
+		return nil, ErrTxNotWritable
+	}
+	n := string(name)
+	b := &memBucket{
+		vals: make(map[string][]byte),
+	}
+	t.m.bkts[n] = b
+	t.undo = append(t.undo, func() { delete(t.m.bkts, n) })
+	return &memTxBucket{b: b, tx: t}, nil
+}
+
+func (t *memTx) Buckets() [][]byte {
+	names := make([]string, 0, len(t.m.bkts))
+	for n := range t.m.bkts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	bs := make([][]byte, len(names))
+	for i, n := range names {
+		bs[i] = []byte(n)
+	}
+	return bs
+}
+
+type memBucket struct {
+	keys []string
+	vals map[string][]byte
+}
+
+func (b *memBucket) set(k string, v []byte) {
+	if _, ok := b.vals[k]; !ok {
+		i := sort.SearchStrings(b.keys, k)
+		b.keys = append(b.keys, "")
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = k
+	}
+	b.vals[k] = v
+}
+
+func (b *memBucket) remove(k string) {
+	if _, ok := b.vals[k]; !ok {
+		return
+	}
+	i := sort.SearchStrings(b.keys, k)
+	b.keys = append(b.keys[:i], b.keys[i+1:]...)
+	delete(b.vals, k)
+}
+
+type memTxBucket struct {
+	b  *memBucket
+	tx *memTx
+}
+
+func (b *memTxBucket) Get(key []byte) []byte { return b.b.vals[string(key)] }
+
+func (b *memTxBucket) Put(key, value []byte) error {
+	if !b.tx.writable {
+		return ErrTxNotWritable
+	}
+	k := string(key)
+	b.saveUndo(k)
+	b.b.set(k, append([]byte(nil), value...))
+	return nil
+}
+
+func (b *memTxBucket) Delete(key []byte) error {
+	if !b.tx.writable {
+		return ErrTxNotWritable
+	}
+	k := string(key)
+	b.saveUndo(k)
+	b.b.remove(k)
+	return nil
+}
+
+func (b *memTxBucket) saveUndo(k string) {
+	if prev, ok := b.b.vals[k]; ok {
+		b.tx.undo = append(b.tx.undo, func() { b.b.set(k, prev) })
+	} else {
+		b.tx.undo = append(b.tx.undo, func() { b.b.remove(k) })
+	}
+}
+
+func (b *memTxBucket) Cursor() MetaCursor { return &memCursor{b: b.b} }
+
+type memCursor struct {
+	b *memBucket
+	i int
+}
+
+func (c *memCursor) kv() ([]byte, []byte) {
+	if c.i >= len(c.b.keys) {
+		return nil, nil
+	}
+	k := c.b.keys[c.i]
+	return []byte(k), c.b.vals[k]
+}
+
+func (c *memCursor) First() ([]byte, []byte) {
+	c.i = 0
+	return c.kv()
+}
+
+func (c *memCursor) Seek(seek []byte) ([]byte, []byte) {
+	c.i = sort.SearchStrings(c.b.keys, string(seek))
+	return c.kv()
+}
+
+func (c *memCursor) Next() ([]byte, []byte) {
+	c.i++
+	return c.kv()
+}
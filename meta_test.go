@@ -0,0 +1,177 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/boltdb/bolt"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemMetaRollback(t *testing.T) {
+	m := newMemMeta()
+	bkt := []byte("bkt")
+
+	err := m.Update(func(tx MetaTx) error {
+		b, err := tx.CreateBucketIfNotExists(bkt)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("a"), []byte("1"))
+	})
+	assert.NoError(t, err)
+
+	errTest := errors.String("test")
+	err = m.Update(func(tx MetaTx) error {
+		b := tx.Bucket(bkt)
+		b.Put([]byte("a"), []byte("2"))
+		b.Put([]byte("b"), []byte("3"))
+		tx.CreateBucketIfNotExists([]byte("other"))
+		return errTest
+	})
+	assert.Equal(t, errTest, err)
+
+	m.View(func(tx MetaTx) error {
+		assert.Nil(t, tx.Bucket([]byte("other")))
+		b := tx.Bucket(bkt)
+		assert.Equal(t, []byte("1"), b.Get([]byte("a")))
+		assert.Nil(t, b.Get([]byte("b")))
+		k, _ := b.Cursor().First()
+		assert.Equal(t, []byte("a"), k)
+		assert.Equal(t, ErrTxNotWritable, b.Put([]byte("c"), nil))
+		return nil
+	})
+}
+
+// testMeta counts Updates and can be set to fail them.
+type testMeta struct {
+	*memMeta
+	updates int
+	fail    bool
+}
+
+func (m *testMeta) Update(fn func(tx MetaTx) error) error {
+	m.updates++
+	return m.memMeta.Update(func(tx MetaTx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if m.fail {
+			return errors.String("test fail")
+		}
+		return nil
+	})
+}
+
+func TestBatchedWrites(t *testing.T) {
+	m := &testMeta{memMeta: newMemMeta()}
+	f, err := newForest(crypto.RandomSymmetric(), m, newMemStore(), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	data := make([]byte, BlockSize*12)
+	rand.Read(data)
+	m.updates = 0
+	tr, err := f.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 1, m.updates)
+
+	to := OpenMemory(crypto.RandomSymmetric())
+	m = &testMeta{memMeta: to.meta.(*memMeta)}
+	to.meta = m
+	sp := to.New(tr.Digest(), tr.leaves)
+
+	vc, l, err := tr.GetLeaf(3)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrBadLeaf, sp.AddLeaf(vc, l, 4))
+
+	m.updates = 0
+	assert.NoError(t, sp.AddLeaf(vc, l, 3))
+	assert.Equal(t, 1, m.updates)
+	assert.NoError(t, sp.AddLeaf(vc, l, 3))
+
+	// a failed transaction is rolled back
+	vc, l, err = tr.GetLeaf(4)
+	assert.NoError(t, err)
+	m.fail = true
+	assert.Error(t, sp.AddLeaf(vc, l, 4))
+	assert.False(t, sp.leavesComplete[4])
+	assert.False(t, to.GetTree(tr.Digest()).leavesComplete[4])
+	m.fail = false
+
+	for i := 0; i < int(tr.leaves); i++ {
+		vc, l, err := tr.GetLeaf(i)
+		assert.NoError(t, err)
+		assert.NoError(t, sp.AddLeaf(vc, l, i))
+	}
+	out, err := sp.ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+}
+
+func TestSharedBoltMeta(t *testing.T) {
+	dirStr := "TestSharedBoltMeta"
+	os.RemoveAll(dirStr)
+	assert.NoError(t, os.MkdirAll(dirStr, 0777))
+
+	db, err := bolt.Open(filepath.Join(dirStr, "app.db"), 0600, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// the app has a bucket with the same name as the branch bucket
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(branchBkt)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("app"), []byte("data"))
+	})
+	assert.NoError(t, err)
+
+	key := crypto.RandomSymmetric()
+	f, err := OpenWithOptions(dirStr, key, &Options{
+		MetaStore: NewBoltMeta(db, []byte("forest")),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	data := make([]byte, BlockSize*3)
+	rand.Read(data)
+	tr, err := f.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	f.Close()
+
+	// the DB is still open and the app bucket is untouched
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(branchBkt)
+		assert.Equal(t, []byte("data"), b.Get([]byte("app")))
+		k, _ := b.Cursor().Next()
+		assert.Nil(t, k)
+		assert.NotNil(t, tx.Bucket([]byte("forest")).Bucket(treeBkt))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	f, err = OpenWithOptions(dirStr, key, &Options{
+		MetaStore: NewBoltMeta(db, []byte("forest")),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	out, err := f.GetTree(tr.Digest()).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+	f.Close()
+
+	assert.NoError(t, db.Close())
+	assert.NoError(t, os.RemoveAll(dirStr))
+}
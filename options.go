@@ -0,0 +1,270 @@
+package merkle
+
+import (
+	"bytes"
+	"github.com/boltdb/bolt"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"github.com/dist-ribut-us/serial"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Options configure a Forest opened with OpenWithOptions. The zero value of
+// each field gives the same behavior as Open.
+type Options struct {
+	// FileMode is used when creating the Bolt DB, leaf files and PackStore
+	// segments. Defaults to 0666, before the umask.
+	FileMode os.FileMode
+	// DirMode is used when creating the Forest directory and shard
+	// directories. Defaults to 0777, before the umask.
+	DirMode os.FileMode
+	// Timeout is how long to wait for the lock on the Bolt DB. Defaults to one
+	// second.
+	Timeout time.Duration
+	// ReadOnly opens an existing Forest without allowing any writes. See
+	// OpenReadOnly.
+	ReadOnly bool
+	// BlockSize is the size of each leaf. It is saved when the Forest is
+	// created and must match when the Forest is reopened. If it is 0, the saved
+	// block size is used or BlockSize for a new Forest.
+	BlockSize int
+	// Durability sets when leaves are flushed to disk.
+	Durability Durability
+	// ShardLevels is the number of levels of sub directories used by the
+	// default DirStore.
+	ShardLevels int
+	// LeafStore replaces the default DirStore.
+	LeafStore LeafStore
+	// MetaStore replaces the default Bolt DB in the Forest directory. If it is
+	// set, FileMode and Timeout are not used for it.
+	MetaStore MetaStore
+	// LeafCacheSize and BranchCacheSize limit the memory, in bytes, used to
+	// cache decrypted leaves and branches. If they are 0 the defaults are used,
+	// if they are negative that cache is disabled.
+	LeafCacheSize   int
+	BranchCacheSize int
+	// Clock is used to decide when trees expire. Defaults to time.Now.
+	Clock func() time.Time
+	// ExpireInterval is how often expired trees are removed in the
+	// background. If it is 0, they are only removed by ExpireNow.
+	ExpireInterval time.Duration
+	// DiskBudget is the number of bytes of leaves the Forest should hold. If it
+	// is more than 0, Evict removes the least recently used trees until the
+	// Forest is within the budget.
+	DiskBudget int64
+	// EvictInterval is how often Evict is called in the background if there is
+	// a DiskBudget.
+	EvictInterval time.Duration
+	// Quota limits the bytes used by all the trees in the Forest. If it is 0,
+	// there is no limit.
+	Quota int64
+	// NamespaceQuotas limits the bytes used by the trees in each namespace. A
+	// namespace that is not in the map is only limited by the Quota.
+	NamespaceQuotas map[string]int64
+	// OnError is called with the errors from removing expired trees and
+	// evicting in the background.
+	OnError func(error)
+}
+
+// TreeOptions configure a tree created with BuildTreeWithOptions or
+// NewWithOptions.
+type TreeOptions struct {
+	// Expires is when the tree is removed from the Forest. If it is zero, the
+	// tree does not expire.
+	Expires time.Time
+	// Namespace is the namespace the tree is counted against for quotas.
+	Namespace string
+	// Meta is saved with the tree. It can be changed later with SetMeta.
+	Meta *TreeMeta
+}
+
+// ErrBlockSize is returned when opening a Forest with a different BlockSize
+// than it was created with.
+const ErrBlockSize = errors.String("Block size does not match Forest")
+
+// ErrBadBlockSize is returned if the BlockSize in the Options is out of range.
+const ErrBadBlockSize = errors.String("Block size must be between 1 and 65535")
+
+var cfgBkt = []byte("c")
+var blockSizeKey = []byte("blocksize")
+
+func (o *Options) withDefaults() *Options {
+	out := &Options{}
+	if o != nil {
+		*out = *o
+	}
+	if out.FileMode == 0 {
+		out.FileMode = 0666
+	}
+	if out.DirMode == 0 {
+		out.DirMode = 0777
+	}
+	if out.Timeout == 0 {
+		out.Timeout = time.Second
+	}
+	if out.LeafCacheSize == 0 {
+		out.LeafCacheSize = DefaultLeafCacheSize
+	}
+	if out.BranchCacheSize == 0 {
+		out.BranchCacheSize = DefaultBranchCacheSize
+	}
+	if out.Clock == nil {
+		out.Clock = time.Now
+	}
+	return out
+}
+
+// OpenWithOptions opens or creates a Forest in dirStr. If opts is nil, it is
+// the same as Open.
+func OpenWithOptions(dirStr string, key *crypto.Symmetric, opts *Options) (*Forest, error) {
+	opts = opts.withDefaults()
+	if opts.BlockSize < 0 || opts.BlockSize > 65535 {
+		return nil, ErrBadBlockSize
+	}
+	if !opts.ReadOnly {
+		if err := os.MkdirAll(dirStr, opts.DirMode); err != nil {
+			return nil, err
+		}
+	}
+	dir, err := filepath.Abs(dirStr)
+	if err != nil {
+		return nil, err
+	}
+	meta := opts.MetaStore
+	if meta == nil {
+		db, err := bolt.Open(filepath.Join(dir, "merkle.db"), opts.FileMode, &bolt.Options{
+			Timeout:  opts.Timeout,
+			ReadOnly: opts.ReadOnly,
+		})
+		if err != nil {
+			return nil, err
+		}
+		meta = &BoltMeta{
+			db:    db,
+			owned: true,
+		}
+	}
+	store := opts.LeafStore
+	if store == nil {
+		ds := NewShardedDirStore(dir, opts.ShardLevels)
+		ds.fileMode = opts.FileMode
+		ds.dirMode = opts.DirMode
+		store = ds
+	} else if ps, ok := store.(*PackStore); ok {
+		ps.fileMode = opts.FileMode
+	}
+	f, err := newForest(key, meta, store, opts)
+	if err != nil {
+		return nil, err
+	}
+	if ds, ok := store.(*DirStore); ok && f.created {
+		// so it doesn't look for leaves in the other layouts
+		if err = ds.markIfEmpty(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	f.dir = dir
+	return f, nil
+}
+
+// setup creates the buckets, validates the key and loads the block size. In a
+// read only Forest nothing is created.
+func (f *Forest) setup(tx MetaTx, opts *Options) error {
+	if !f.readOnly {
+		for _, bkt := range [][]byte{branchBkt, inlineBkt, treeBkt, cfgBkt, refBkt, accessBkt, usageBkt, pinBkt} {
+			if _, err := tx.CreateBucketIfNotExists(bkt); err != nil {
+				return err
+			}
+		}
+	}
+	b := tx.Bucket(treeBkt)
+	if b == nil {
+		return ErrBucketDoesNotExist
+	}
+	if cfg := tx.Bucket(cfgBkt); cfg != nil {
+		if v := cfg.Get(rekeyKey); v != nil {
+			if err := f.resumeRekey(v); err != nil {
+				return err
+			}
+		}
+	}
+	// the key validation is stored in the treeBkt because it is unlikely
+	// to collied with a tree
+	isNew := false
+	v := b.Get(validateKey)
+	if v == nil {
+		if f.readOnly {
+			return ErrBucketDoesNotExist
+		}
+		isNew = true
+		f.created = true
+		if err := b.Put(validateKey, f.key().Seal(validateKey, nil)); err != nil {
+			return err
+		}
+	} else if v, err := f.open(v); err != nil {
+		return err
+	} else if !bytes.Equal(v, validateKey) {
+		return crypto.ErrDecryptionFailed
+	}
+
+	f.blockSize = BlockSize
+	if isNew && opts.BlockSize != 0 {
+		f.blockSize = opts.BlockSize
+	}
+	var cfg MetaBucket
+	if cfg = tx.Bucket(cfgBkt); cfg != nil {
+		if v := cfg.Get(blockSizeKey); v != nil {
+			v, err := f.open(v)
+			if err != nil {
+				return err
+			}
+			f.blockSize = int(serial.UnmarshalUint32(v))
+		} else if !f.readOnly {
+			// a Forest from before the block size was saved uses BlockSize
+			v := make([]byte, 4)
+			serial.MarshalUint32(uint32(f.blockSize), v)
+			if err := cfg.Put(blockSizeKey, f.key().Seal(v, nil)); err != nil {
+				return err
+			}
+		}
+	}
+	if opts.BlockSize != 0 && opts.BlockSize != f.blockSize {
+		return ErrBlockSize
+	}
+	if cfg != nil && !f.readOnly && !f.refsCurrent(cfg) {
+		if isNew {
+			if err := cfg.Put(refsKey, f.key().Seal(refsVersion, nil)); err != nil {
+				return err
+			}
+		} else if err := f.rebuildRefs(tx); err == nil {
+			// the leaves are counted from the rebuilt references
+			if err = f.rebuildStats(tx); err != nil {
+				return err
+			}
+		} else if err != ErrUnreadable {
+			return err
+		}
+		// if a record can't be read the references are rebuilt by Repair
+	}
+	if cfg != nil && !f.readOnly && cfg.Get(usageKey) == nil {
+		// a Forest from before usage was kept
+		if !isNew {
+			if err := f.rebuildUsage(tx); err != nil {
+				return err
+			}
+		}
+		if err := cfg.Put(usageKey, f.key().Seal(usageKey, nil)); err != nil {
+			return err
+		}
+	}
+	if cfg != nil && !f.readOnly && cfg.Get(statsKey) == nil && !isNew {
+		// a Forest from before stats were kept
+		if err := f.rebuildStats(tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
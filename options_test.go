@@ -0,0 +1,67 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenWithOptions(t *testing.T) {
+	dirStr := "TestOpenWithOptions"
+	os.RemoveAll(dirStr)
+	key := crypto.RandomSymmetric()
+
+	f, err := OpenWithOptions(dirStr, key, &Options{
+		FileMode:    0600,
+		BlockSize:   1024,
+		ShardLevels: 1,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	data := make([]byte, 5000)
+	rand.Read(data)
+	tr, err := f.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, uint32(5), tr.leaves)
+	assert.Equal(t, 5000, tr.Len())
+	f.Close()
+
+	info, err := os.Stat(filepath.Join(dirStr, "merkle.db"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	_, err = OpenWithOptions(dirStr, key, &Options{BlockSize: 2048})
+	assert.Equal(t, ErrBlockSize, err)
+	_, err = OpenWithOptions(dirStr, key, &Options{BlockSize: 1 << 16})
+	assert.Equal(t, ErrBadBlockSize, err)
+
+	f, err = OpenWithOptions(dirStr, key, &Options{
+		ReadOnly:    true,
+		ShardLevels: 1,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 1024, f.blockSize)
+	out, err := f.GetTree(tr.Digest()).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+	f.Close()
+
+	// the default of Open is the BlockSize constant
+	f, err = Open(filepath.Join(dirStr, "default"), key)
+	if assert.NoError(t, err) {
+		assert.Equal(t, BlockSize, f.blockSize)
+		f.Close()
+	}
+
+	assert.NoError(t, os.RemoveAll(dirStr))
+}
@@ -0,0 +1,656 @@
+package merkle
+
+import (
+	"fmt"
+	"github.com/dist-ribut-us/errors"
+	"github.com/dist-ribut-us/serial"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PackStore is a LeafStore that appends leaves to large segment files instead
+// of using a file per leaf. This uses far fewer files and leaves that are
+// written together, like the leaves of a tree, are read back sequentially.
+// The location of each leaf is kept in an encrypted index in the Forest's
+// Bolt DB, so a PackStore can only be used by a single Forest.
+//
+// Deleting a leaf only removes it from the index, the space is reclaimed by
+// Compact.
+//
+// When the Durability is SyncTree, the index entries for new leaves are held
+// in memory until Sync has flushed the segments, so the index never points at
+// data that is not on disk.
+type PackStore struct {
+	dir        string
+	segSize    int64
+	fileMode   os.FileMode
+	f          *Forest
+	mux        sync.RWMutex
+	segMux     sync.Mutex
+	segs       map[uint32]*os.File
+	active     uint32
+	activeLen  int64
+	durability Durability
+	pending    map[uint32]bool
+	unsynced   map[string]packEntry
+}
+
+// DefaultSegmentSize is the size at which a PackStore starts a new segment
+// file.
+const DefaultSegmentSize = 64 << 20
+
+// maxSegmentSize keeps offsets within 32 bits.
+const maxSegmentSize = 1<<31 - 1
+
+// ErrNotAttached is returned when a PackStore is used before the Forest using
+// it is opened.
+const ErrNotAttached = errors.String("PackStore is not attached to a Forest")
+
+var packBkt = []byte("p")
+var segBkt = []byte("s")
+
+const segPrefix = "pack-"
+
+// NewPackStore returns a PackStore that keeps its segment files in dir. If
+// segSize is 0, DefaultSegmentSize is used. The directory must already exist.
+func NewPackStore(dir string, segSize int64) *PackStore {
+	if segSize <= 0 {
+		segSize = DefaultSegmentSize
+	} else if segSize > maxSegmentSize {
+		segSize = maxSegmentSize
+	}
+	return &PackStore{
+		dir:      dir,
+		segSize:  segSize,
+		fileMode: 0666,
+		segs:     make(map[uint32]*os.File),
+		pending:  make(map[uint32]bool),
+		unsynced: make(map[string]packEntry),
+	}
+}
+
+func (s *PackStore) attach(f *Forest) error {
+	s.f = f
+	if !f.readOnly {
+		err := f.meta.Update(func(tx MetaTx) error {
+			if _, err := tx.CreateBucketIfNotExists(packBkt); err != nil {
+				return err
+			}
+			_, err := tx.CreateBucketIfNotExists(segBkt)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	ids, err := s.segmentIDs()
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		s.active = ids[len(ids)-1]
+	}
+	return s.openActive()
+}
+
+// segmentIDs returns the ids of the segment files in order.
+func (s *PackStore) segmentIDs() ([]uint32, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, segPrefix) {
+			continue
+		}
+		id, err := strconv.ParseUint(name[len(segPrefix):], 16, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+func (s *PackStore) segPath(id uint32) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%08x", segPrefix, id))
+}
+
+// openActive opens the active segment for writing and sets activeLen. It is
+// a no op for a read only Forest.
+func (s *PackStore) openActive() error {
+	if s.f.readOnly {
+		return nil
+	}
+	file, err := os.OpenFile(s.segPath(s.active), os.O_RDWR|os.O_CREATE, s.fileMode)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.segMux.Lock()
+	if old, ok := s.segs[s.active]; ok {
+		old.Close()
+	}
+	s.segs[s.active] = file
+	s.segMux.Unlock()
+	s.activeLen = info.Size()
+	return nil
+}
+
+// segment returns the file for a segment, opening it if needed.
+func (s *PackStore) segment(id uint32) (*os.File, error) {
+	s.segMux.Lock()
+	defer s.segMux.Unlock()
+	if file, ok := s.segs[id]; ok {
+		return file, nil
+	}
+	file, err := os.Open(s.segPath(id))
+	if err != nil {
+		return nil, err
+	}
+	s.segs[id] = file
+	return file, nil
+}
+
+func (s *PackStore) closeSegment(id uint32) {
+	s.segMux.Lock()
+	if file, ok := s.segs[id]; ok {
+		file.Close()
+		delete(s.segs, id)
+	}
+	s.segMux.Unlock()
+}
+
+type packEntry struct {
+	seg, off, ln uint32
+}
+
+func (e packEntry) marshal() []byte {
+	b := make([]byte, 12)
+	serial.MarshalUint32(e.seg, b)
+	serial.MarshalUint32(e.off, b[4:])
+	serial.MarshalUint32(e.ln, b[8:])
+	return b
+}
+
+func unmarshalPackEntry(b []byte) (packEntry, bool) {
+	if len(b) != 12 {
+		return packEntry{}, false
+	}
+	return packEntry{
+		seg: serial.UnmarshalUint32(b),
+		off: serial.UnmarshalUint32(b[4:]),
+		ln:  serial.UnmarshalUint32(b[8:]),
+	}, true
+}
+
+func segKey(id uint32) []byte {
+	b := make([]byte, 4)
+	serial.MarshalUint32(id, b)
+	return b
+}
+
+// entry looks up the location of a leaf in the index, or in the entries that
+// are waiting for a Sync. Must be called while holding the lock.
+func (s *PackStore) entry(tx MetaTx, key []byte) (packEntry, bool) {
+	if e, ok := s.unsynced[string(key)]; ok {
+		return e, true
+	}
+	return s.indexed(tx, key)
+}
+
+// indexed looks up the location of a leaf in the index.
+func (s *PackStore) indexed(tx MetaTx, key []byte) (packEntry, bool) {
+	bkt := tx.Bucket(packBkt)
+	if bkt == nil {
+		return packEntry{}, false
+	}
+	v := bkt.Get(key)
+	if v == nil {
+		return packEntry{}, false
+	}
+	v, err := s.f.open(v)
+	if err != nil {
+		return packEntry{}, false
+	}
+	return unmarshalPackEntry(v)
+}
+
+// addLive adjusts the live byte count of a segment.
+func (s *PackStore) addLive(tx MetaTx, id uint32, delta int64) error {
+	bkt := tx.Bucket(segBkt)
+	k := segKey(id)
+	var live int64
+	if v := bkt.Get(k); v != nil {
+		if v, err := s.f.open(v); err == nil && len(v) == 4 {
+			live = int64(serial.UnmarshalUint32(v))
+		}
+	}
+	live += delta
+	if live <= 0 {
+		return bkt.Delete(k)
+	}
+	v := make([]byte, 4)
+	serial.MarshalUint32(uint32(live), v)
+	return bkt.Put(k, s.f.key().Seal(v, nil))
+}
+
+// live returns the live byte count of every segment.
+func (s *PackStore) live() map[uint32]int64 {
+	live := make(map[uint32]int64)
+	s.f.meta.View(func(tx MetaTx) error {
+		bkt := tx.Bucket(segBkt)
+		if bkt == nil {
+			return nil
+		}
+		c := bkt.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if v, err := s.f.open(v); err == nil && len(v) == 4 && len(k) == 4 {
+				live[serial.UnmarshalUint32(k)] = int64(serial.UnmarshalUint32(v))
+			}
+		}
+		return nil
+	})
+	return live
+}
+
+// Put appends a leaf to the active segment. If the leaf is already in the
+// PackStore, it is not written again.
+func (s *PackStore) Put(key, leaf []byte) error {
+	if s.f == nil {
+		return ErrNotAttached
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if ok, _ := s.has(key); ok {
+		return nil
+	}
+	return s.put(key, leaf)
+}
+
+// put must be called while holding the write lock. When the Durability is
+// SyncTree, the index entry waits for Sync.
+func (s *PackStore) put(key, leaf []byte) error {
+	if s.durability != SyncTree && len(s.unsynced) > 0 {
+		// left from before the Durability was changed
+		if err := s.sync(); err != nil {
+			return err
+		}
+	}
+	e, err := s.appendLeaf(leaf)
+	if err != nil {
+		return err
+	}
+	if s.durability == SyncTree {
+		s.unsynced[string(key)] = e
+		return nil
+	}
+	return s.index(map[string]packEntry{string(key): e})
+}
+
+// index adds entries to the index. Must be called while holding the write
+// lock.
+func (s *PackStore) index(entries map[string]packEntry) error {
+	return s.f.meta.Update(func(tx MetaTx) error {
+		bkt := tx.Bucket(packBkt)
+		for k, e := range entries {
+			if err := bkt.Put([]byte(k), s.f.key().Seal(e.marshal(), nil)); err != nil {
+				return err
+			}
+			if err := s.addLive(tx, e.seg, int64(e.ln)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// appendLeaf writes a leaf to the end of the active segment, starting a new
+// segment if it is full. Must be called while holding the write lock.
+func (s *PackStore) appendLeaf(leaf []byte) (packEntry, error) {
+	if s.activeLen > 0 && s.activeLen+int64(len(leaf)) > s.segSize {
+		if err := s.syncSegment(s.active); err != nil {
+			return packEntry{}, err
+		}
+		s.active++
+		if err := s.openActive(); err != nil {
+			return packEntry{}, err
+		}
+	}
+	if s.f.readOnly {
+		return packEntry{}, ErrReadOnly
+	}
+	file, err := s.segment(s.active)
+	if err != nil {
+		return packEntry{}, err
+	}
+	e := packEntry{
+		seg: s.active,
+		off: uint32(s.activeLen),
+		ln:  uint32(len(leaf)),
+	}
+	if _, err := file.WriteAt(leaf, s.activeLen); err != nil {
+		return e, err
+	}
+	s.activeLen += int64(len(leaf))
+	switch s.durability {
+	case SyncLeaf:
+		err = s.syncSegment(s.active)
+	case SyncTree:
+		s.pending[s.active] = true
+	}
+	return e, err
+}
+
+// Get reads a leaf from its segment.
+func (s *PackStore) Get(key []byte) ([]byte, error) {
+	if s.f == nil {
+		return nil, ErrNotAttached
+	}
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	var e packEntry
+	var ok bool
+	s.f.meta.View(func(tx MetaTx) error {
+		e, ok = s.entry(tx, key)
+		return nil
+	})
+	if !ok {
+		return nil, ErrLeafNotFound
+	}
+	file, err := s.segment(e.seg)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, e.ln)
+	if _, err = file.ReadAt(b, int64(e.off)); err == io.EOF {
+		// the segment was cut short, like after a crash with SyncNone
+		return nil, ErrCorrupt
+	}
+	return b, err
+}
+
+// Has checks the index for a leaf.
+func (s *PackStore) Has(key []byte) (bool, error) {
+	if s.f == nil {
+		return false, ErrNotAttached
+	}
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.has(key)
+}
+
+func (s *PackStore) has(key []byte) (bool, error) {
+	var ok bool
+	err := s.f.meta.View(func(tx MetaTx) error {
+		_, ok = s.entry(tx, key)
+		return nil
+	})
+	return ok, err
+}
+
+// Delete removes a leaf from the index. The space in the segment is reclaimed
+// by Compact. Deleting a leaf that does not exist is not an error.
+func (s *PackStore) Delete(key []byte) error {
+	if s.f == nil {
+		return ErrNotAttached
+	}
+	if s.f.readOnly {
+		return ErrReadOnly
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, ok := s.unsynced[string(key)]; ok {
+		delete(s.unsynced, string(key))
+		return nil
+	}
+	return s.f.meta.Update(func(tx MetaTx) error {
+		e, ok := s.indexed(tx, key)
+		if !ok {
+			return nil
+		}
+		if err := tx.Bucket(packBkt).Delete(key); err != nil {
+			return err
+		}
+		return s.addLive(tx, e.seg, -int64(e.ln))
+	})
+}
+
+// Compact rewrites every segment, other than the active segment, that is less
+// than half live data. The live leaves are appended to the active segment and
+// the old segment is removed. It returns the number of segments removed.
+func (s *PackStore) Compact() (int, error) {
+	if s.f == nil {
+		return 0, ErrNotAttached
+	}
+	if s.f.readOnly {
+		return 0, ErrReadOnly
+	}
+	// the live counts don't include entries waiting for a Sync
+	s.mux.Lock()
+	err := s.sync()
+	s.mux.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	ids, err := s.segmentIDs()
+	if err != nil {
+		return 0, err
+	}
+	live := s.live()
+	compact := make(map[uint32][]packKey)
+	for _, id := range ids {
+		if id == s.active {
+			continue
+		}
+		info, err := os.Stat(s.segPath(id))
+		if err != nil {
+			return 0, err
+		}
+		if live[id]*2 < info.Size() {
+			compact[id] = nil
+		}
+	}
+	if len(compact) == 0 {
+		return 0, nil
+	}
+
+	// one pass over the index finds the leaves in all of the segments
+	s.f.meta.View(func(tx MetaTx) error {
+		c := tx.Bucket(packBkt).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			e, ok := s.indexed(tx, k)
+			if !ok {
+				continue
+			}
+			if keys, ok := compact[e.seg]; ok {
+				compact[e.seg] = append(keys, packKey{
+					key:   append([]byte(nil), k...),
+					entry: e,
+				})
+			}
+		}
+		return nil
+	})
+
+	removed := 0
+	for _, id := range ids {
+		keys, ok := compact[id]
+		if !ok {
+			continue
+		}
+		if err = s.compactSegment(id, keys); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// packKey is a leaf found in the index.
+type packKey struct {
+	key   []byte
+	entry packEntry
+}
+
+// compactSegment moves the live leaves out of a segment then removes it. The
+// leaves are appended to the active segment and flushed before the index is
+// updated, so a leaf is never lost if compaction is interrupted. A leaf that
+// was deleted after the index was read is not moved.
+func (s *PackStore) compactSegment(id uint32, keys []packKey) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	file, err := s.segment(id)
+	if err != nil {
+		return err
+	}
+	moved := make([]packEntry, len(keys))
+	segs := make(map[uint32]bool)
+	for i, k := range keys {
+		b := make([]byte, k.entry.ln)
+		if _, err = file.ReadAt(b, int64(k.entry.off)); err != nil {
+			return err
+		}
+		if moved[i], err = s.appendLeaf(b); err != nil {
+			return err
+		}
+		segs[moved[i].seg] = true
+	}
+	for seg := range segs {
+		delete(s.pending, seg)
+		if err = s.flushSegment(seg); err != nil {
+			return err
+		}
+	}
+	err = s.f.meta.Update(func(tx MetaTx) error {
+		bkt := tx.Bucket(packBkt)
+		for i, k := range keys {
+			if e, ok := s.indexed(tx, k.key); !ok || e != k.entry {
+				continue
+			}
+			e := moved[i]
+			if err := bkt.Put(k.key, s.f.key().Seal(e.marshal(), nil)); err != nil {
+				return err
+			}
+			if err := s.addLive(tx, e.seg, int64(e.ln)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(segBkt).Delete(segKey(id))
+	})
+	if err != nil {
+		return err
+	}
+	s.closeSegment(id)
+	return os.Remove(s.segPath(id))
+}
+
+// SetDurability sets when segments are flushed to disk.
+func (s *PackStore) SetDurability(d Durability) {
+	s.mux.Lock()
+	s.durability = d
+	s.mux.Unlock()
+}
+
+// Sync flushes every segment written since the last Sync, then adds the
+// leaves written since then to the index.
+func (s *PackStore) Sync() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.sync()
+}
+
+// sync must be called while holding the write lock. Segments are only pending
+// if they were written with SyncTree, so they are flushed even if the
+// Durability has changed since.
+func (s *PackStore) sync() error {
+	for id := range s.pending {
+		if err := s.flushSegment(id); err != nil {
+			return err
+		}
+		delete(s.pending, id)
+	}
+	if len(s.unsynced) == 0 {
+		return nil
+	}
+	if err := s.index(s.unsynced); err != nil {
+		return err
+	}
+	s.unsynced = make(map[string]packEntry)
+	return nil
+}
+
+// SyncKeys flushes the segments holding the leaves to disk and adds any that
+// are waiting for a Sync to the index. Keys that are not in the PackStore are
+// skipped.
+func (s *PackStore) SyncKeys(keys [][]byte) error {
+	if s.f == nil {
+		return ErrNotAttached
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	ids := make(map[uint32]bool)
+	s.f.meta.View(func(tx MetaTx) error {
+		for _, key := range keys {
+			if e, ok := s.entry(tx, key); ok {
+				ids[e.seg] = true
+			}
+		}
+		return nil
+	})
+	for id := range ids {
+		delete(s.pending, id)
+		if err := s.flushSegment(id); err != nil {
+			return err
+		}
+	}
+	return s.sync()
+}
+
+// syncSegment flushes a segment and the directory unless the Durability is
+// SyncNone. Must be called while holding the write lock.
+func (s *PackStore) syncSegment(id uint32) error {
+	delete(s.pending, id)
+	if s.durability == SyncNone {
+		return nil
+	}
+	return s.flushSegment(id)
+}
+
+// flushSegment flushes a segment and the directory.
+func (s *PackStore) flushSegment(id uint32) error {
+	file, err := s.segment(id)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	return syncPath(s.dir)
+}
+
+// Close closes all the segment files.
+func (s *PackStore) Close() error {
+	s.segMux.Lock()
+	defer s.segMux.Unlock()
+	var err error
+	for id, file := range s.segs {
+		if cErr := file.Close(); err == nil {
+			err = cErr
+		}
+		delete(s.segs, id)
+	}
+	return err
+}
@@ -0,0 +1,171 @@
+package merkle
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestPackStore(t *testing.T) {
+	dirStr := "TestPackStore"
+	os.RemoveAll(dirStr)
+	assert.NoError(t, os.MkdirAll(dirStr, 0777))
+	key := crypto.RandomSymmetric()
+
+	leafLen := int64(BlockSize + overhead)
+	store := NewPackStore(dirStr, 4*leafLen)
+	f, err := OpenWithStore(dirStr, key, store)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	data := make([]byte, BlockSize*10)
+	rand.Read(data)
+	tr, err := f.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	out, err := tr.ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+
+	ids, err := store.segmentIDs()
+	assert.NoError(t, err)
+	assert.Len(t, ids, 3)
+
+	// writing the same leaf again does not use more space
+	_, err = f.writeLeaf(data[:BlockSize], BlockSize)
+	assert.NoError(t, err)
+	assert.Equal(t, leafLen*3, store.activeLen)
+
+	var ds []*crypto.Digest
+	for i := 0; i < 8; i++ {
+		leaf := make([]byte, BlockSize)
+		rand.Read(leaf)
+		d, err := f.writeLeaf(leaf, BlockSize)
+		assert.NoError(t, err)
+		ds = append(ds, d)
+	}
+	for _, d := range ds[:6] {
+		assert.NoError(t, store.Delete(f.sealDigest(d)))
+	}
+	_, err = f.readLeaf(ds[0])
+	assert.Equal(t, ErrLeafNotFound, err)
+
+	removed, err := store.Compact()
+	assert.NoError(t, err)
+	assert.True(t, removed > 0)
+
+	for _, d := range ds[6:] {
+		_, err := f.readLeaf(d)
+		assert.NoError(t, err)
+	}
+	f.Close()
+
+	// the index survives a reopen
+	store = NewPackStore(dirStr, 4*leafLen)
+	f, err = OpenWithStore(dirStr, key, store)
+	if !assert.NoError(t, err) {
+		return
+	}
+	out, err = f.GetTree(tr.Digest()).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+
+	f.Close()
+	assert.NoError(t, os.RemoveAll(dirStr))
+}
+
+func TestPackStoreSyncTree(t *testing.T) {
+	dirStr := "TestPackStoreSyncTree"
+	os.RemoveAll(dirStr)
+	assert.NoError(t, os.MkdirAll(dirStr, 0777))
+	store := NewPackStore(dirStr, 0)
+	f, err := OpenWithOptions(dirStr, crypto.RandomSymmetric(), &Options{
+		LeafStore: store,
+		FileMode:  0600,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	info, err := os.Stat(store.segPath(store.active))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// the index entry waits until the segment is flushed
+	f.SetDurability(SyncTree)
+	leaf := make([]byte, BlockSize)
+	rand.Read(leaf)
+	d, err := f.writeLeaf(leaf, BlockSize)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, bucketLen(f, packBkt))
+	out, err := f.readLeaf(d)
+	assert.NoError(t, err)
+	assert.Equal(t, leaf, out)
+	assert.NoError(t, store.Sync())
+	assert.Equal(t, 1, bucketLen(f, packBkt))
+	assert.Len(t, store.pending, 0)
+
+	// and a tree is only saved after Sync
+	data := make([]byte, BlockSize*3)
+	rand.Read(data)
+	tr, err := f.BuildTree(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Len(t, store.unsynced, 0)
+	assert.Equal(t, 1+int(tr.leaves), bucketLen(f, packBkt))
+
+	// a deleted leaf that was never indexed is just dropped
+	d, err = f.writeLeaf(data[:BlockSize-1], BlockSize-1)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Delete(f.sealDigest(d)))
+	assert.NoError(t, store.Sync())
+	assert.Equal(t, 1+int(tr.leaves), bucketLen(f, packBkt))
+
+	f.Close()
+	assert.NoError(t, os.RemoveAll(dirStr))
+}
+
+func TestPackStoreTruncated(t *testing.T) {
+	dirStr := "TestPackStoreTruncated"
+	os.RemoveAll(dirStr)
+	assert.NoError(t, os.MkdirAll(dirStr, 0777))
+	key := crypto.RandomSymmetric()
+	store := NewPackStore(dirStr, 0)
+	f, err := OpenWithStore(dirStr, key, store)
+	if !assert.NoError(t, err) {
+		return
+	}
+	data := make([]byte, BlockSize*3+100)
+	rand.Read(data)
+	tr, err := f.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	seg := store.segPath(store.active)
+	f.Close()
+
+	// the end of the segment is lost, like after a crash
+	info, err := os.Stat(seg)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(seg, info.Size()-10))
+
+	store = NewPackStore(dirStr, 0)
+	f, err = OpenWithStore(dirStr, key, store)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tr = f.GetTree(tr.Digest())
+	_, err = tr.ReadAll()
+	assert.Equal(t, ErrCorrupt, err)
+	assert.False(t, tr.Complete())
+	r, err := f.Verify(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, r.OK())
+
+	f.Close()
+	assert.NoError(t, os.RemoveAll(dirStr))
+}
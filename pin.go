@@ -0,0 +1,104 @@
+package merkle
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"github.com/dist-ribut-us/serial"
+)
+
+// A pinned tree is never removed by DeleteTree, ExpireNow or Evict. Pins are
+// counted so that separate parts of an application can pin the same tree, it
+// stays pinned until each of them calls Unpin. The count for each tree is kept
+// in the pinBkt.
+var pinBkt = []byte("n")
+
+// ErrPinned is returned when trying to delete a pinned tree.
+const ErrPinned = errors.String("Tree is pinned")
+
+// ErrNotPinned is returned by Unpin if the tree is not pinned.
+const ErrNotPinned = errors.String("Tree is not pinned")
+
+func (f *Forest) getPinTx(tx MetaTx, d *crypto.Digest) uint32 {
+	bkt := tx.Bucket(pinBkt)
+	if bkt == nil {
+		return 0
+	}
+	v, err := f.open(f.getSealed(bkt, d.Slice()))
+	if err != nil || len(v) != 4 {
+		return 0
+	}
+	return serial.UnmarshalUint32(v)
+}
+
+func (f *Forest) setPinTx(tx MetaTx, key []byte, n uint32) error {
+	if n == 0 {
+		return tx.Bucket(pinBkt).Delete(key)
+	}
+	v := make([]byte, 4)
+	serial.MarshalUint32(n, v)
+	return tx.Bucket(pinBkt).Put(key, f.key().Seal(v, nil))
+}
+
+// Pin protects a tree from being removed. The tree must be in the Forest.
+func (f *Forest) Pin(d *crypto.Digest) error {
+	f.treeMux.RLock()
+	defer f.treeMux.RUnlock()
+	if err := f.writable(); err != nil {
+		return err
+	}
+	return f.meta.Update(func(tx MetaTx) error {
+		key := f.sealDigest(d)
+		if tx.Bucket(treeBkt).Get(key) == nil {
+			return ErrTreeNotFound
+		}
+		return f.setPinTx(tx, key, f.getPinTx(tx, d)+1)
+	})
+}
+
+// Unpin removes one pin from a tree.
+func (f *Forest) Unpin(d *crypto.Digest) error {
+	f.treeMux.RLock()
+	defer f.treeMux.RUnlock()
+	if err := f.writable(); err != nil {
+		return err
+	}
+	return f.meta.Update(func(tx MetaTx) error {
+		key := f.sealDigest(d)
+		n := f.getPinTx(tx, d)
+		if n == 0 {
+			return ErrNotPinned
+		}
+		return f.setPinTx(tx, key, n-1)
+	})
+}
+
+// IsPinned returns true if the tree has at least one pin.
+func (f *Forest) IsPinned(d *crypto.Digest) bool {
+	var n uint32
+	f.meta.View(func(tx MetaTx) error {
+		n = f.getPinTx(tx, d)
+		return nil
+	})
+	return n > 0
+}
+
+// Pinned returns the digests of all the pinned trees.
+func (f *Forest) Pinned() ([]*crypto.Digest, error) {
+	var ds []*crypto.Digest
+	err := f.meta.View(func(tx MetaTx) error {
+		bkt := tx.Bucket(pinBkt)
+		if bkt == nil {
+			return nil
+		}
+		c := bkt.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			d, err := f.openKey(k, zeroNonce)
+			if err != nil {
+				return err
+			}
+			ds = append(ds, crypto.DigestFromSlice(d))
+		}
+		return nil
+	})
+	return ds, err
+}
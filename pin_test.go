@@ -0,0 +1,68 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPin(t *testing.T) {
+	clock := &testClock{now: time.Unix(1000000, 0)}
+	f, err := newForest(crypto.RandomSymmetric(), newMemMeta(), newMemStore(), &Options{
+		Clock:      clock.Now,
+		DiskBudget: 1,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	data := make([]byte, BlockSize*2)
+	rand.Read(data)
+	tr, err := f.BuildTreeWithOptions(bytes.NewReader(data), &TreeOptions{
+		Expires: clock.Now().Add(time.Minute),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	d := tr.Digest()
+
+	assert.Equal(t, ErrTreeNotFound, f.Pin(crypto.GetDigest([]byte("missing"))))
+	assert.Equal(t, ErrNotPinned, f.Unpin(d))
+
+	// pinned twice
+	assert.NoError(t, f.Pin(d))
+	assert.NoError(t, f.Pin(d))
+	assert.True(t, f.IsPinned(d))
+	ps, err := f.Pinned()
+	assert.NoError(t, err)
+	if assert.Len(t, ps, 1) {
+		assert.Equal(t, d, ps[0])
+	}
+
+	assert.Equal(t, ErrPinned, f.DeleteTree(d))
+	clock.Add(time.Minute)
+	assert.NotNil(t, f.GetTree(d))
+	n, err := f.ExpireNow()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	n, err = f.Evict()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	_, err = f.GC()
+	assert.NoError(t, err)
+	out, err := f.GetTree(d).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+
+	assert.NoError(t, f.Unpin(d))
+	assert.True(t, f.IsPinned(d))
+	assert.NoError(t, f.Unpin(d))
+	assert.False(t, f.IsPinned(d))
+	assert.Nil(t, f.GetTree(d))
+	n, err = f.ExpireNow()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
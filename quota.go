@@ -0,0 +1,162 @@
+package merkle
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"github.com/dist-ribut-us/serial"
+)
+
+// Every tree is counted against the quota of its namespace. A complete tree
+// uses its length and a sapling reserves space for all of its leaves. Leaves
+// shared by trees are counted for each tree. The bytes used by each namespace
+// are kept in the usageBkt.
+var usageBkt = []byte("u")
+var usageKey = []byte("usage")
+
+// ErrQuotaExceeded is returned when a write would take the Forest or a
+// namespace over its quota.
+const ErrQuotaExceeded = errors.String("Quota exceeded")
+
+func (t *Tree) quotaSize() int64 {
+	if t.complete {
+		return int64(t.Len())
+	}
+	return int64(t.leaves) * int64(t.f.blockSize)
+}
+
+// checkSapling checks that a sapling with l leaves fits in the quotas before
+// anything is allocated for it, so a huge leaf count is refused without using
+// the memory. The quotas are checked again when the tree is saved.
+func (f *Forest) checkSapling(d *crypto.Digest, l uint32, ns string) error {
+	avail, limited := f.available(ns)
+	size := int64(l) * int64(f.blockSize)
+	if !limited || size <= avail {
+		return nil
+	}
+	// replacing a tree in the same namespace only charges the change
+	var old *Tree
+	f.meta.View(func(tx MetaTx) error {
+		old = f.getTreeTx(tx, d)
+		return nil
+	})
+	if old != nil && old.namespace == ns && size <= avail+old.quotaSize() {
+		return nil
+	}
+	return ErrQuotaExceeded
+}
+
+func (f *Forest) namespaceKey(ns string) []byte {
+	return seal(f.key(), []byte(ns))
+}
+
+func (f *Forest) getUsageTx(tx MetaTx, key []byte) int64 {
+	bkt := tx.Bucket(usageBkt)
+	if bkt == nil {
+		return 0
+	}
+	v, err := f.open(bkt.Get(key))
+	if err != nil || len(v) != 8 {
+		return 0
+	}
+	return int64(serial.UnmarshalUint64(v))
+}
+
+func (f *Forest) setUsageTx(tx MetaTx, key []byte, u int64) error {
+	if u <= 0 {
+		return tx.Bucket(usageBkt).Delete(key)
+	}
+	v := make([]byte, 8)
+	serial.MarshalUint64(uint64(u), v)
+	return tx.Bucket(usageBkt).Put(key, f.key().Seal(v, nil))
+}
+
+// totalUsageTx is the bytes used by all namespaces.
+func (f *Forest) totalUsageTx(tx MetaTx) int64 {
+	var total int64
+	c := tx.Bucket(usageBkt).Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		total += f.getUsageTx(tx, k)
+	}
+	return total
+}
+
+// chargeTx adds delta bytes to the usage of a namespace. If delta is positive
+// and the usage would go over a quota, ErrQuotaExceeded is returned.
+func (f *Forest) chargeTx(tx MetaTx, ns string, delta int64) error {
+	if delta > 0 {
+		if q, ok := f.nsQuotas[ns]; ok && f.getUsageTx(tx, f.namespaceKey(ns))+delta > q {
+			return ErrQuotaExceeded
+		}
+		if f.quota > 0 && f.totalUsageTx(tx)+delta > f.quota {
+			return ErrQuotaExceeded
+		}
+	}
+	return f.addUsageTx(tx, ns, delta)
+}
+
+// addUsageTx adds delta bytes to the usage of a namespace without checking the
+// quotas.
+func (f *Forest) addUsageTx(tx MetaTx, ns string, delta int64) error {
+	key := f.namespaceKey(ns)
+	return f.setUsageTx(tx, key, f.getUsageTx(tx, key)+delta)
+}
+
+// available returns how many more bytes can be used in a namespace, it is
+// negative if the namespace is over quota. If there is no quota that applies to
+// the namespace, limited is false.
+func (f *Forest) available(ns string) (avail int64, limited bool) {
+	f.meta.View(func(tx MetaTx) error {
+		if q, ok := f.nsQuotas[ns]; ok {
+			avail = q - f.getUsageTx(tx, f.namespaceKey(ns))
+			limited = true
+		}
+		if f.quota > 0 {
+			if a := f.quota - f.totalUsageTx(tx); !limited || a < avail {
+				avail = a
+			}
+			limited = true
+		}
+		return nil
+	})
+	return
+}
+
+// Usage returns the bytes used by the trees in a namespace.
+func (f *Forest) Usage(ns string) int64 {
+	var u int64
+	f.meta.View(func(tx MetaTx) error {
+		u = f.getUsageTx(tx, f.namespaceKey(ns))
+		return nil
+	})
+	return u
+}
+
+// rebuildUsage replaces the usage of every namespace with the usage computed
+// from the tree records.
+func (f *Forest) rebuildUsage(tx MetaTx) error {
+	usage := make(map[string]int64)
+	err := f.eachTree(tx, func(t *Tree) error {
+		usage[t.namespace] += t.quotaSize()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	bkt := tx.Bucket(usageBkt)
+	var keys [][]byte
+	c := bkt.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	for _, k := range keys {
+		if err = bkt.Delete(k); err != nil {
+			return err
+		}
+	}
+	for ns, u := range usage {
+		if err = f.setUsageTx(tx, f.namespaceKey(ns), u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	bs := int64(BlockSize)
+	f, err := newForest(crypto.RandomSymmetric(), newMemMeta(), newMemStore(), &Options{
+		Quota:           bs * 10,
+		NamespaceQuotas: map[string]int64{"a": bs * 3},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	a := &TreeOptions{Namespace: "a"}
+
+	data := make([]byte, BlockSize*4)
+	rand.Read(data)
+	tr, err := f.BuildTreeWithOptions(bytes.NewReader(data[:BlockSize*2]), a)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "a", f.GetTree(tr.Digest()).Namespace())
+	assert.Equal(t, bs*2, f.Usage("a"))
+
+	_, err = f.BuildTreeWithOptions(bytes.NewReader(data[BlockSize*2:]), a)
+	assert.Equal(t, ErrQuotaExceeded, err)
+	assert.Equal(t, bs*2, f.Usage("a"))
+
+	// saplings reserve space for all their leaves
+	src := OpenMemory(crypto.RandomSymmetric())
+	srcTr, err := src.BuildTree(bytes.NewReader(data[:100]))
+	assert.NoError(t, err)
+	_, err = f.NewWithOptions(srcTr.Digest(), 2, a)
+	assert.Equal(t, ErrQuotaExceeded, err)
+	s, err := f.NewWithOptions(srcTr.Digest(), 1, a)
+	assert.NoError(t, err)
+	assert.Equal(t, bs*3, f.Usage("a"))
+
+	_, err = f.NewWithOptions(crypto.GetDigest([]byte("big")), 8, nil)
+	assert.Equal(t, ErrQuotaExceeded, err)
+	// a huge sapling is refused before space for its leaves is allocated
+	_, err = f.NewWithOptions(crypto.GetDigest([]byte("huge")), math.MaxUint32, nil)
+	assert.Equal(t, ErrQuotaExceeded, err)
+	big, err := f.NewWithOptions(crypto.GetDigest([]byte("big")), 7, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, bs*7, f.Usage(""))
+
+	// a complete tree uses its length
+	vc, leaf, err := srcTr.GetLeaf(0)
+	assert.NoError(t, err)
+	assert.NoError(t, s.AddLeaf(vc, leaf, 0))
+	assert.True(t, s.Complete())
+	assert.Equal(t, bs*2+100, f.Usage("a"))
+
+	assert.NoError(t, f.DeleteTree(big.Digest()))
+	assert.Equal(t, int64(0), f.Usage(""))
+
+	// a sapling can be completed and a tree built again after the quota is
+	// lowered
+	srcTr, err = src.BuildTree(bytes.NewReader(data[100:200]))
+	assert.NoError(t, err)
+	s, err = f.NewWithOptions(srcTr.Digest(), 1, nil)
+	assert.NoError(t, err)
+	f.quota = bs
+	vc, leaf, err = srcTr.GetLeaf(0)
+	assert.NoError(t, err)
+	assert.NoError(t, s.AddLeaf(vc, leaf, 0))
+	assert.True(t, s.Complete())
+	again, err := f.BuildTreeWithOptions(bytes.NewReader(data[:BlockSize*2]), a)
+	assert.NoError(t, err)
+	assert.Equal(t, tr.Digest(), again.Digest())
+	assert.Equal(t, bs*2+100, f.Usage("a"))
+
+	// no leaf is written once the quota would be exceeded
+	store := f.leaves.(*memStore)
+	leaves := len(store.leaves)
+	_, err = f.BuildTree(bytes.NewReader(data[BlockSize : BlockSize*3]))
+	assert.Equal(t, ErrQuotaExceeded, err)
+	assert.Len(t, store.leaves, leaves)
+}
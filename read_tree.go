@@ -1,6 +1,7 @@
 package merkle
 
 import (
+	"context"
 	"github.com/dist-ribut-us/crypto"
 	"github.com/dist-ribut-us/errors"
 	"io"
@@ -11,16 +12,56 @@ import (
 // Tree.Complete()
 const ErrIncomplete = errors.String("Tree is incomplete")
 
+// ErrCorrupt is returned when reading a tree finds a leaf or branch that is
+// missing, can't be decrypted or does not match its digest. The tree is
+// repaired as Repair would, so the leaves that were lost are marked incomplete
+// and can be added again with AddLeaf.
+const ErrCorrupt = errors.String("Tree is corrupt")
+
+// repair is called when a read returns ErrCorrupt. The tree is repaired and t
+// is updated to match. If the repair fails, its error is returned instead.
+func (t *Tree) repair(err error) error {
+	if err != ErrCorrupt || t.f.writable() != nil {
+		return err
+	}
+	if _, rErr := t.f.repairTree(context.Background(), t.dig); rErr != nil {
+		return rErr
+	}
+	if nt := t.f.GetTree(t.dig); nt != nil {
+		t.complete, t.leavesComplete = nt.complete, nt.leavesComplete
+	}
+	return err
+}
+
 // ReadAll reads the contents of a tree into a byte slice
 func (t *Tree) ReadAll() ([]byte, error) {
 	if !t.complete {
 		return nil, ErrIncomplete
 	}
-	l := int(t.leaves-1)*BlockSize + int(t.lastBlockLen)
+	t.f.touch(t.dig)
+	l := t.Len()
 	b := make([]byte, l)
 	var startAt int64
 	_, err := recursiveRead(b, &startAt, t.dig, t.leaves == 1, t.f, true, int(t.lastBlockLen))
-	return b, err
+	if err != nil {
+		return nil, t.repair(err)
+	}
+	return b, nil
+}
+
+// readTreeLeaf reads a leaf that a tree has, so if it is not found or the first
+// ln bytes don't match the digest the tree is corrupt.
+func readTreeLeaf(f *Forest, d *crypto.Digest, ln int) ([]byte, error) {
+	l, err := f.readLeaf(d)
+	if err == ErrLeafNotFound {
+		return nil, ErrCorrupt
+	} else if err != nil {
+		return nil, err
+	}
+	if len(l) < ln || !crypto.GetDigest(l[:ln]).Equal(d) {
+		return nil, ErrCorrupt
+	}
+	return l, nil
 }
 
 // ValidationChain is used to validate that a leaf belongs to a tree. It
@@ -37,11 +78,18 @@ func recursiveRead(b []byte, startAt *int64, d *crypto.Digest, isLeaf bool, f *F
 				return 0, io.EOF
 			}
 		} else {
-			*startAt -= BlockSize
+			*startAt -= int64(f.blockSize)
+		}
+		ln := f.blockSize
+		if rightMost {
+			ln = lastLen
 		}
 		l := 0
 		if *startAt <= 0 {
-			lf, _ := f.readLeaf(d)
+			lf, err := readTreeLeaf(f, d, ln)
+			if err != nil {
+				return 0, err
+			}
 			if rightMost {
 				lf = lf[:lastLen]
 			}
@@ -60,11 +108,16 @@ func recursiveRead(b []byte, startAt *int64, d *crypto.Digest, isLeaf bool, f *F
 		return l, nil
 	}
 	br := f.readBranch(d)
+	if br == nil {
+		return 0, ErrCorrupt
+	}
 	lb := len(b)
 	l := 0
 	var err error
 	if lb > 0 {
-		l, _ = recursiveRead(b, startAt, br.left, br.lIsLeaf(), f, false, lastLen)
+		if l, err = recursiveRead(b, startAt, br.left, br.lIsLeaf(), f, false, lastLen); err != nil {
+			return l, err
+		}
 	}
 	var r int
 	if lb > l {
@@ -73,21 +126,36 @@ func recursiveRead(b []byte, startAt *int64, d *crypto.Digest, isLeaf bool, f *F
 	return l + r, err
 }
 
-// GetLeaf returns the ValidationChain and Leaf for a tree.
+// GetLeaf returns the ValidationChain and Leaf for a tree. If the tree is a
+// sapling that does not have the leaf, ErrIncomplete is returned.
 func (t *Tree) GetLeaf(lIdx int) (ValidationChain, []byte, error) {
-	vc, l, err := recursiveGetLeaf(uint32(lIdx), 0, t.leaves, t.dig, t.leaves == 1, t.f)
-	if lbl := int(t.lastBlockLen); lIdx == int(t.leaves)-1 && len(l) > lbl {
-		l = l[:lbl]
+	if lIdx < 0 || lIdx >= int(t.leaves) {
+		return nil, nil, ErrBadLeaf
 	}
-	return vc, l, err
+	if !t.complete && !t.leavesComplete[lIdx] {
+		return nil, nil, ErrIncomplete
+	}
+	t.f.touch(t.dig)
+	ln := t.f.blockSize
+	if lIdx == int(t.leaves)-1 {
+		ln = int(t.lastBlockLen)
+	}
+	vc, l, err := recursiveGetLeaf(uint32(lIdx), 0, t.leaves, t.dig, t.leaves == 1, ln, t.f)
+	if err != nil {
+		return nil, nil, t.repair(err)
+	}
+	return vc, l[:ln], nil
 }
 
-func recursiveGetLeaf(lIdx, start, end uint32, d *crypto.Digest, isLeaf bool, f *Forest) ([]*crypto.Digest, []byte, error) {
+func recursiveGetLeaf(lIdx, start, end uint32, d *crypto.Digest, isLeaf bool, ln int, f *Forest) ([]*crypto.Digest, []byte, error) {
 	if isLeaf {
-		l, err := f.readLeaf(d)
+		l, err := readTreeLeaf(f, d, ln)
 		return nil, l, err
 	}
 	b := f.readBranch(d)
+	if b == nil {
+		return nil, nil, ErrCorrupt
+	}
 	mid := (start + end) / 2
 	var ud *crypto.Digest
 	if lIdx < mid || lIdx == start {
@@ -101,7 +169,7 @@ func recursiveGetLeaf(lIdx, start, end uint32, d *crypto.Digest, isLeaf bool, f
 		ud = b.left
 		isLeaf = b.rIsLeaf()
 	}
-	us, l, err := recursiveGetLeaf(lIdx, start, end, d, isLeaf, f)
+	us, l, err := recursiveGetLeaf(lIdx, start, end, d, isLeaf, ln, f)
 	return append(us, ud), l, err
 }
 
@@ -148,9 +216,13 @@ func (t *Tree) Read(p []byte) (int, error) {
 	if !t.complete {
 		return 0, ErrIncomplete
 	}
+	t.f.touch(t.dig)
 	startAt := t.pos
 	n, err := recursiveRead(p, &startAt, t.dig, t.leaves == 1, t.f, true, int(t.lastBlockLen))
 	t.pos += int64(n)
+	if err != nil && err != io.EOF {
+		err = t.repair(err)
+	}
 	return n, err
 }
 
@@ -183,5 +255,5 @@ func (t *Tree) Seek(offset int64, whence int) (int64, error) {
 
 // Len returns the byte size of the tree
 func (t *Tree) Len() int {
-	return (int(t.leaves-1)*BlockSize + int(t.lastBlockLen))
+	return (int(t.leaves-1)*t.f.blockSize + int(t.lastBlockLen))
 }
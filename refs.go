@@ -0,0 +1,321 @@
+package merkle
+
+import (
+	"bytes"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"github.com/dist-ribut-us/serial"
+)
+
+// Leaves and branches are content addressed and can be shared by many trees,
+// so each keeps a reference count. A node is referenced once by each tree
+// record that has it as a root and once by each distinct branch record that
+// has it as a child. When the count reaches zero, the node is removed.
+//
+// A sapling's branches reference leaves it doesn't have yet, so the record also
+// counts how many of the references mark the node as a leaf that is present:
+// a branch with the leaf bit for that side set, or a complete tree with a
+// single leaf. A leaf is counted in the stats while that count is above zero.
+
+var refBkt = []byte("r")
+
+// refsKey marks a Forest that keeps reference counts, its value is refsVersion.
+// Counts from before refsVersion don't say which leaves are present and are
+// rebuilt.
+var refsKey = []byte("refs")
+var refsVersion = []byte("leaves")
+
+// ErrTreeNotFound is returned when trying to delete a tree that is not in the
+// Forest.
+const ErrTreeNotFound = errors.String("Tree not found")
+
+// refsCurrent is true if the reference counts are in the refsVersion format.
+func (f *Forest) refsCurrent(cfg MetaBucket) bool {
+	v, err := f.open(cfg.Get(refsKey))
+	return err == nil && bytes.Equal(v, refsVersion)
+}
+
+// nodeRef is the reference count of a node and how many of those references
+// mark it as a present leaf.
+type nodeRef struct {
+	refs, leaves uint32
+}
+
+func (f *Forest) getRef(tx MetaTx, key []byte) nodeRef {
+	v := tx.Bucket(refBkt).Get(key)
+	if v == nil {
+		return nodeRef{}
+	}
+	v, err := f.open(v)
+	if err != nil || (len(v) != 4 && len(v) != 8) {
+		return nodeRef{}
+	}
+	r := nodeRef{refs: serial.UnmarshalUint32(v)}
+	if len(v) == 8 {
+		r.leaves = serial.UnmarshalUint32(v[4:])
+	}
+	return r
+}
+
+func (f *Forest) setRef(tx MetaTx, key []byte, r nodeRef) error {
+	if r.refs == 0 {
+		return tx.Bucket(refBkt).Delete(key)
+	}
+	v := make([]byte, 8)
+	serial.MarshalUint32(r.refs, v)
+	serial.MarshalUint32(r.leaves, v[4:])
+	return tx.Bucket(refBkt).Put(key, f.key().Seal(v, nil))
+}
+
+// addRef adjusts the reference count of a node and the number of references
+// that mark it as a present leaf. The leaf is added to or removed from the
+// stats when it becomes or stops being present. It returns the new count.
+func (f *Forest) addRef(tx MetaTx, d *crypto.Digest, refs, leaves int) (uint32, error) {
+	key := f.sealDigest(d)
+	r := f.getRef(tx, key)
+	was := r.leaves > 0
+	r.refs = addCount(r.refs, refs)
+	r.leaves = addCount(r.leaves, leaves)
+	if r.leaves > r.refs {
+		r.leaves = r.refs
+	}
+	if err := f.setRef(tx, key, r); err != nil {
+		return 0, err
+	}
+	if is := r.leaves > 0; is != was {
+		n := int64(1)
+		if was {
+			n = -1
+		}
+		if err := f.addStatTx(tx, statLeaves, n); err != nil {
+			return 0, err
+		}
+	}
+	return r.refs, nil
+}
+
+// addCount adds n to c without going below zero.
+func addCount(c uint32, n int) uint32 {
+	if n < 0 && uint32(-n) > c {
+		return 0
+	}
+	return uint32(int64(c) + int64(n))
+}
+
+func boolCount(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// refChildren takes a reference to both children of a new branch and counts
+// the branch in the stats.
+func (f *Forest) refChildren(tx MetaTx, br *branch) error {
+	if _, err := f.addRef(tx, br.left, 1, boolCount(br.lIsLeaf())); err != nil {
+		return err
+	}
+	if _, err := f.addRef(tx, br.right, 1, boolCount(br.rIsLeaf())); err != nil {
+		return err
+	}
+	return f.addStatTx(tx, statBranches, 1)
+}
+
+// markLeaves sets the bits in p on a branch that is already saved. A child
+// whose leaf bit is newly set is marked as a present leaf.
+func (f *Forest) markLeaves(tx MetaTx, br *branch, p byte) error {
+	p &^= br.pattern
+	br.pattern |= p
+	if p&lLeafMask != 0 {
+		if _, err := f.addRef(tx, br.left, 0, 1); err != nil {
+			return err
+		}
+	}
+	if p&rLeafMask != 0 {
+		if _, err := f.addRef(tx, br.right, 0, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// release drops a reference to a node, isLeaf is true if the reference marks
+// it as a present leaf. If nothing else references the node, it is removed and
+// the references it holds are released. Leaves are only removed from the
+// inline bucket, the digests of leaves to remove from the LeafStore are
+// appended to dead so that can be done after the transaction.
+func (f *Forest) release(tx MetaTx, d *crypto.Digest, isLeaf bool, dead *[]*crypto.Digest) error {
+	n, err := f.addRef(tx, d, -1, -boolCount(isLeaf))
+	if err != nil || n > 0 {
+		return err
+	}
+	key := f.sealDigest(d)
+	if br := f.readBranchTx(tx, d); br != nil {
+		if err = tx.Bucket(branchBkt).Delete(key); err != nil {
+			return err
+		}
+		if err = f.addStatTx(tx, statBranches, -1); err != nil {
+			return err
+		}
+		if err = f.release(tx, br.left, br.lIsLeaf(), dead); err != nil {
+			return err
+		}
+		return f.release(tx, br.right, br.rIsLeaf(), dead)
+	}
+	if err = tx.Bucket(inlineBkt).Delete(key); err != nil {
+		return err
+	}
+	*dead = append(*dead, d)
+	return nil
+}
+
+// DeleteTree removes a tree from the Forest. Any leaves and branches that are
+// not used by another tree are removed as well. A pinned tree can't be
+// deleted. The tree record, branches and reference counts are all updated in a
+// single transaction. Leaves are removed from the LeafStore after that
+// transaction, if that is interrupted the leaves are left as garbage but no
+// tree is damaged.
+func (f *Forest) DeleteTree(d *crypto.Digest) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	f.treeMux.Lock()
+	defer f.treeMux.Unlock()
+
+	var dead []*crypto.Digest
+	err := f.meta.Update(func(tx MetaTx) error {
+		dead = dead[:0]
+		return f.deleteTreeTx(tx, d, &dead)
+	})
+	if err != nil {
+		return err
+	}
+	return f.removeLeaves(dead)
+}
+
+// deleteTreeTx removes a tree record, releases its root and frees its usage.
+func (f *Forest) deleteTreeTx(tx MetaTx, d *crypto.Digest, dead *[]*crypto.Digest) error {
+	key := f.sealDigest(d)
+	tb := tx.Bucket(treeBkt)
+	if tb.Get(key) == nil {
+		return ErrTreeNotFound
+	}
+	if f.getPinTx(tx, d) > 0 {
+		return ErrPinned
+	}
+	t := f.getTreeTx(tx, d)
+	if t != nil {
+		if err := f.chargeTx(tx, t.namespace, -t.quotaSize()); err != nil {
+			return err
+		}
+		if err := f.addStatsTx(tx, negStats(treeStats(t))); err != nil {
+			return err
+		}
+	}
+	if err := tb.Delete(key); err != nil {
+		return err
+	}
+	if err := tx.Bucket(accessBkt).Delete(key); err != nil {
+		return err
+	}
+	return f.release(tx, d, t != nil && t.rootIsLeaf(), dead)
+}
+
+// removeLeaves is called after a transaction that released nodes has been
+// committed to remove the dead leaves from the LeafStore.
+func (f *Forest) removeLeaves(dead []*crypto.Digest) error {
+	// branches that were removed may still be cached
+	f.branchCache.purge()
+	for _, ld := range dead {
+		f.leafCache.remove(ld)
+		if err := f.leaves.Delete(f.sealDigest(ld)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrUnreadable is returned by GC if a tree record or branch can't be read.
+// Everything below it would look unreachable, so nothing is removed. Repair
+// will quarantine the record.
+const ErrUnreadable = errors.String("Record can not be read, run Repair")
+
+// countRefs computes the reference count of every node reachable from a tree
+// record. If a tree record or a branch that is present can't be read, it
+// returns ErrUnreadable.
+func (f *Forest) countRefs(tx MetaTx) (map[crypto.Digest]nodeRef, error) {
+	counts := make(map[crypto.Digest]nodeRef)
+	add := func(d *crypto.Digest, isLeaf bool) {
+		r := counts[*d]
+		r.refs++
+		r.leaves += uint32(boolCount(isLeaf))
+		counts[*d] = r
+	}
+	seen := make(map[crypto.Digest]bool)
+	bb := tx.Bucket(branchBkt)
+	var visit func(d *crypto.Digest) error
+	visit = func(d *crypto.Digest) error {
+		if seen[*d] {
+			return nil
+		}
+		seen[*d] = true
+		br := f.readBranchTx(tx, d)
+		if br == nil {
+			if f.getSealed(bb, d.Slice()) != nil {
+				return ErrUnreadable
+			}
+			// a leaf or a branch a sapling doesn't have yet
+			return nil
+		}
+		add(br.left, br.lIsLeaf())
+		add(br.right, br.rIsLeaf())
+		if err := visit(br.left); err != nil {
+			return err
+		}
+		return visit(br.right)
+	}
+	ds, bad := f.treeKeys(tx)
+	if len(bad) > 0 {
+		return nil, ErrUnreadable
+	}
+	for _, d := range ds {
+		t := f.getTreeTx(tx, d)
+		if t == nil {
+			return nil, ErrUnreadable
+		}
+		add(d, t.rootIsLeaf())
+		if err := visit(d); err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+// rebuildRefs replaces all the reference counts with ones computed from the
+// tree records and marks them as refsVersion. It is used to add reference
+// counts to a Forest created before they were kept or before they recorded
+// which leaves are present.
+func (f *Forest) rebuildRefs(tx MetaTx) error {
+	counts, err := f.countRefs(tx)
+	if err != nil {
+		return err
+	}
+	bkt := tx.Bucket(refBkt)
+	var keys [][]byte
+	c := bkt.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	for _, k := range keys {
+		if err = bkt.Delete(k); err != nil {
+			return err
+		}
+	}
+	for d, r := range counts {
+		d := d
+		if err = f.setRef(tx, f.sealDigest(&d), r); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(cfgBkt).Put(refsKey, f.key().Seal(refsVersion, nil))
+}
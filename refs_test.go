@@ -0,0 +1,122 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func bucketLen(f *Forest, bkt []byte) int {
+	n := 0
+	f.meta.View(func(tx MetaTx) error {
+		c := tx.Bucket(bkt).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+func assertRefsConsistent(t *testing.T, f *Forest) {
+	f.meta.View(func(tx MetaTx) error {
+		counts, err := f.countRefs(tx)
+		assert.NoError(t, err)
+		assert.Equal(t, len(counts), bucketLen(f, refBkt))
+		for d, n := range counts {
+			d := d
+			assert.Equal(t, n, f.getRef(tx, f.sealDigest(&d)))
+		}
+		return nil
+	})
+}
+
+func TestDeleteTree(t *testing.T) {
+	f := OpenMemory(crypto.RandomSymmetric())
+	store := f.leaves.(*memStore)
+
+	data := make([]byte, BlockSize*6)
+	rand.Read(data)
+	// b shares its first 3 leaves with a
+	a, err := f.BuildTree(bytes.NewReader(data[:BlockSize*3+10]))
+	if !assert.NoError(t, err) {
+		return
+	}
+	b, err := f.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	small, err := f.BuildTree(bytes.NewReader(data[:10]))
+	if !assert.NoError(t, err) {
+		return
+	}
+	// building the same tree again does not add references
+	_, err = f.BuildTree(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assertRefsConsistent(t, f)
+
+	assert.NoError(t, f.DeleteTree(a.Digest()))
+	assert.Nil(t, f.GetTree(a.Digest()))
+	assert.Equal(t, ErrTreeNotFound, f.DeleteTree(a.Digest()))
+	assertRefsConsistent(t, f)
+	assert.Equal(t, int(b.leaves), len(store.leaves))
+
+	out, err := f.GetTree(b.Digest()).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+
+	assert.NoError(t, f.DeleteTree(b.Digest()))
+	assert.NoError(t, f.DeleteTree(small.Digest()))
+	assert.Len(t, store.leaves, 0)
+	assert.Equal(t, 0, bucketLen(f, branchBkt))
+	assert.Equal(t, 0, bucketLen(f, inlineBkt))
+	assert.Equal(t, 0, bucketLen(f, refBkt))
+
+	// saplings can be deleted too
+	src := OpenMemory(crypto.RandomSymmetric())
+	tr, err := src.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	sp := f.New(tr.Digest(), tr.leaves)
+	for i := 0; i < 3; i++ {
+		vc, l, err := tr.GetLeaf(i)
+		assert.NoError(t, err)
+		assert.NoError(t, sp.AddLeaf(vc, l, i))
+	}
+	assertRefsConsistent(t, f)
+	assert.NoError(t, f.DeleteTree(tr.Digest()))
+	assert.Len(t, store.leaves, 0)
+	assert.Equal(t, 0, bucketLen(f, branchBkt))
+	assert.Equal(t, 0, bucketLen(f, refBkt))
+}
+
+func TestRebuildRefs(t *testing.T) {
+	f := OpenMemory(crypto.RandomSymmetric())
+	data := make([]byte, BlockSize*5)
+	rand.Read(data)
+	tr, err := f.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// drop the counts, as if the Forest was from before they were kept
+	err = f.meta.Update(func(tx MetaTx) error {
+		if err := tx.Bucket(cfgBkt).Delete(refsKey); err != nil {
+			return err
+		}
+		return f.setRef(tx, f.sealDigest(tr.Digest()), nodeRef{})
+	})
+	assert.NoError(t, err)
+
+	f, err = newForest(f.key(), f.meta, f.leaves, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assertRefsConsistent(t, f)
+	assert.NoError(t, f.DeleteTree(tr.Digest()))
+	assert.Equal(t, 0, bucketLen(f, refBkt))
+	assert.Len(t, f.leaves.(*memStore).leaves, 0)
+}
@@ -0,0 +1,460 @@
+package merkle
+
+import (
+	"bytes"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"github.com/dist-ribut-us/serial"
+)
+
+// While a Forest is being rekeyed, everything is written under the new key and
+// read under either key. The progress is saved in the cfg bucket, sealed with
+// the new key, so if the Forest is reopened with the new key the old key is
+// recovered and Rekey can finish.
+var rekeyKey = []byte("rekey")
+
+// rekeyBatch is the number of leaves or records moved to the new key between
+// saves of the progress.
+const rekeyBatch = 1000
+
+// ErrRekeying is returned when writing to a Forest that is being rekeyed, when
+// opening it with the old key, or when calling Rekey with a key other than the
+// one it is being rekeyed to.
+const ErrRekeying = errors.String("Forest is being rekeyed")
+
+// ErrCantListBuckets is returned by Rekey if the MetaStore does not implement
+// MetaBucketLister.
+const ErrCantListBuckets = errors.String("MetaStore can not list buckets")
+
+// forestKeys holds the key and, while the Forest is being rekeyed, the key it
+// is being moved from.
+type forestKeys struct {
+	key, old *crypto.Symmetric
+}
+
+func (f *Forest) key() *crypto.Symmetric { return f.keys.Load().(forestKeys).key }
+
+func (f *Forest) oldKey() *crypto.Symmetric { return f.keys.Load().(forestKeys).old }
+
+func (f *Forest) setKeys(key, old *crypto.Symmetric) {
+	f.keys.Store(forestKeys{key: key, old: old})
+}
+
+// Rekeying returns true if the Forest is being rekeyed. If a Rekey was
+// interrupted, the Forest can still be read but it can't be written until Rekey
+// is called again with the new key.
+func (f *Forest) Rekeying() bool { return f.oldKey() != nil }
+
+// writable returns the error for a write, if any.
+func (f *Forest) writable() error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+	if f.Rekeying() {
+		return ErrRekeying
+	}
+	return nil
+}
+
+// open decrypts a value, trying the old key if the Forest is being rekeyed.
+func (f *Forest) open(b []byte) ([]byte, error) {
+	ks := f.keys.Load().(forestKeys)
+	v, err := ks.key.Open(b)
+	if err != nil && ks.old != nil {
+		v, err = ks.old.Open(b)
+	}
+	return v, err
+}
+
+// openKey decrypts a sealed key, trying the old key if the Forest is being
+// rekeyed.
+func (f *Forest) openKey(k []byte, nonce *crypto.Nonce) ([]byte, error) {
+	ks := f.keys.Load().(forestKeys)
+	v, err := ks.key.NonceOpen(k, nonce)
+	if err != nil && ks.old != nil {
+		v, err = ks.old.NonceOpen(k, nonce)
+	}
+	return v, err
+}
+
+// sealedKeys returns the sealed forms of a key that a record may be stored
+// under, the current key first.
+func (f *Forest) sealedKeys(b []byte) [][]byte {
+	ks := f.keys.Load().(forestKeys)
+	if ks.old == nil {
+		return [][]byte{seal(ks.key, b)}
+	}
+	return [][]byte{seal(ks.key, b), seal(ks.old, b)}
+}
+
+// getSealed looks up a record by its unsealed key.
+func (f *Forest) getSealed(bkt MetaBucket, b []byte) []byte {
+	for _, k := range f.sealedKeys(b) {
+		if v := bkt.Get(k); v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// rekeyState is the progress of a Rekey.
+type rekeyState struct {
+	old *crypto.Symmetric
+	// leaves is true once the leaves have been moved.
+	leaves bool
+	// bkt is the bucket being moved and after is the last key moved in it.
+	bkt, after []byte
+}
+
+func (s *rekeyState) marshal() []byte {
+	b := make([]byte, crypto.SymmetricLength+3, crypto.SymmetricLength+3+len(s.bkt)+len(s.after))
+	copy(b, s.old.Slice())
+	if s.leaves {
+		b[crypto.SymmetricLength] = 1
+	}
+	serial.MarshalUint16(uint16(len(s.bkt)), b[crypto.SymmetricLength+1:])
+	b = append(b, s.bkt...)
+	return append(b, s.after...)
+}
+
+func unmarshalRekeyState(b []byte) *rekeyState {
+	if len(b) < crypto.SymmetricLength+3 {
+		return nil
+	}
+	s := &rekeyState{
+		old:    crypto.SymmetricFromSlice(b[:crypto.SymmetricLength]),
+		leaves: b[crypto.SymmetricLength] == 1,
+	}
+	b = b[crypto.SymmetricLength+1:]
+	l := int(serial.UnmarshalUint16(b)) + 2
+	if len(b) < l {
+		return nil
+	}
+	if l > 2 {
+		s.bkt = append([]byte(nil), b[2:l]...)
+	}
+	if len(b) > l {
+		s.after = append([]byte(nil), b[l:]...)
+	}
+	return s
+}
+
+// resumeRekey is called when a Forest is opened with a Rekey in progress. It
+// fails if the Forest was opened with the old key.
+func (f *Forest) resumeRekey(v []byte) error {
+	v, err := f.key().Open(v)
+	if err != nil {
+		return ErrRekeying
+	}
+	s := unmarshalRekeyState(v)
+	if s == nil {
+		return ErrRekeying
+	}
+	f.setKeys(f.key(), s.old)
+	return nil
+}
+
+func (f *Forest) saveRekeyTx(tx MetaTx, s *rekeyState) error {
+	return tx.Bucket(cfgBkt).Put(rekeyKey, f.key().Seal(s.marshal(), nil))
+}
+
+// Rekey encrypts everything in the Forest under a new key, including the
+// leaves, which are also renamed, and the values saved with SetValue. The
+// Forest can be read while it runs, but writes fail with ErrRekeying. If Rekey
+// is interrupted, the Forest must be opened with the new key and Rekey called
+// again with the new key to finish. Leaves and records that are no longer used
+// are removed, as a GC would, so nothing is left under the old key. The old key
+// is no longer accepted once Rekey returns. If a record can't be read, Rekey
+// returns ErrUnreadable before changing anything and Repair should be run.
+func (f *Forest) Rekey(newKey *crypto.Symmetric) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+	err := f.meta.View(func(tx MetaTx) error {
+		if _, ok := tx.(MetaBucketLister); !ok {
+			return ErrCantListBuckets
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	f.flushAccess()
+	f.treeMux.Lock()
+	defer f.treeMux.Unlock()
+
+	var s *rekeyState
+	if f.Rekeying() {
+		if !bytes.Equal(newKey.Slice(), f.key().Slice()) {
+			return ErrRekeying
+		}
+		f.meta.View(func(tx MetaTx) error {
+			if v, err := newKey.Open(tx.Bucket(cfgBkt).Get(rekeyKey)); err == nil {
+				s = unmarshalRekeyState(v)
+			}
+			return nil
+		})
+		if s == nil {
+			return ErrRekeying
+		}
+	} else {
+		if bytes.Equal(newKey.Slice(), f.key().Slice()) {
+			return nil
+		}
+		// a record that can't be read would stop rekeyLeaves part way, so
+		// check before anything is changed
+		err = f.meta.View(func(tx MetaTx) error {
+			_, err := f.countRefs(tx)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		s = &rekeyState{old: f.key()}
+		err = f.meta.Update(func(tx MetaTx) error {
+			return tx.Bucket(cfgBkt).Put(rekeyKey, newKey.Seal(s.marshal(), nil))
+		})
+		if err != nil {
+			return err
+		}
+		f.setKeys(newKey, s.old)
+	}
+
+	if !s.leaves {
+		if err := f.rekeyLeaves(s.old); err != nil {
+			return err
+		}
+		s.leaves = true
+		err = f.meta.Update(func(tx MetaTx) error {
+			return f.saveRekeyTx(tx, s)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := f.rekeyBuckets(s); err != nil {
+		return err
+	}
+	// GC runs while the old key can still be read, so the PackStore index
+	// entries it removes can be found
+	if _, err := f.gc(); err != nil {
+		return err
+	}
+	err = f.meta.Update(func(tx MetaTx) error {
+		return tx.Bucket(cfgBkt).Delete(rekeyKey)
+	})
+	if err != nil {
+		return err
+	}
+	f.setKeys(newKey, nil)
+	return nil
+}
+
+// rekeyLeaves moves every leaf in the LeafStore that is used by a tree to the
+// new key. Each batch of leaves is written and flushed to disk with SyncKeys
+// before the old ones are deleted, whatever the Durability is, so if it is
+// interrupted every leaf can still be read.
+func (f *Forest) rekeyLeaves(old *crypto.Symmetric) error {
+	var ds []crypto.Digest
+	err := f.meta.View(func(tx MetaTx) error {
+		counts, err := f.countRefs(tx)
+		if err != nil {
+			return err
+		}
+		for d := range counts {
+			d := d
+			if f.readBranchTx(tx, &d) == nil {
+				ds = append(ds, d)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	key := f.key()
+	for len(ds) > 0 {
+		n := rekeyBatch
+		if n > len(ds) {
+			n = len(ds)
+		}
+		var moved, written [][]byte
+		for i := range ds[:n] {
+			d := ds[i].Slice()
+			oldCd := seal(old, d)
+			b, err := f.leaves.Get(oldCd)
+			if err == ErrLeafNotFound {
+				// inline, missing or already moved
+				continue
+			} else if err != nil {
+				return err
+			}
+			cd := seal(key, d)
+			ok, err := f.leaves.Has(cd)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				v, err := old.Open(b)
+				if err != nil {
+					// corrupt, it's left for GC and the tree will need Repair
+					continue
+				}
+				if err = f.leaves.Put(cd, key.Seal(v, nil)); err != nil {
+					return err
+				}
+			}
+			moved = append(moved, oldCd)
+			written = append(written, cd)
+		}
+		if s, ok := f.leaves.(SyncStore); ok {
+			if err := s.SyncKeys(written); err != nil {
+				return err
+			}
+		}
+		for _, cd := range moved {
+			if err := f.leaves.Delete(cd); err != nil {
+				return err
+			}
+		}
+		ds = ds[n:]
+	}
+	return nil
+}
+
+// listBuckets calls fn with the buckets to rekey, the Forest's own buckets
+// first. Leaves in the PackStore index are moved by rekeyLeaves.
+func (f *Forest) listBuckets(fn func([][]byte)) error {
+	return f.meta.View(func(tx MetaTx) error {
+		l, ok := tx.(MetaBucketLister)
+		if !ok {
+			return ErrCantListBuckets
+		}
+		bkts := [][]byte{branchBkt, inlineBkt, treeBkt, cfgBkt, refBkt, accessBkt, usageBkt, pinBkt, quarantineBkt, segBkt}
+		skip := map[string]bool{string(packBkt): true}
+		for _, b := range bkts {
+			skip[string(b)] = true
+		}
+		for _, b := range l.Buckets() {
+			if !skip[string(b)] {
+				bkts = append(bkts, b)
+			}
+		}
+		fn(bkts)
+		return nil
+	})
+}
+
+// rekeyBuckets moves the records in every bucket to the new key, starting from
+// the saved progress.
+func (f *Forest) rekeyBuckets(s *rekeyState) error {
+	var bkts [][]byte
+	if err := f.listBuckets(func(b [][]byte) { bkts = b }); err != nil {
+		return err
+	}
+	start := 0
+	for i, b := range bkts {
+		if bytes.Equal(b, s.bkt) {
+			start = i
+			break
+		}
+	}
+	for i, b := range bkts[start:] {
+		if i > 0 || !bytes.Equal(b, s.bkt) {
+			s.bkt, s.after = b, nil
+		}
+		for done := false; !done; {
+			var err error
+			if done, err = f.rekeyBatchOf(s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rekeyBatchOf moves the next batch of records in a bucket and saves the
+// progress in the same transaction. It returns true at the end of the bucket.
+func (f *Forest) rekeyBatchOf(s *rekeyState) (bool, error) {
+	key := f.key()
+	done := false
+	after := s.after
+	err := f.meta.Update(func(tx MetaTx) error {
+		done, s.after = false, after
+		bkt := tx.Bucket(s.bkt)
+		if bkt == nil {
+			done = true
+			return f.saveRekeyTx(tx, s)
+		}
+		type record struct{ k, nk, nv []byte }
+		var recs []record
+		c := bkt.Cursor()
+		var k, v []byte
+		if s.after == nil {
+			k, v = c.First()
+		} else if k, v = c.Seek(s.after); bytes.Equal(k, s.after) {
+			k, v = c.Next()
+		}
+		for n := 0; k != nil && n < rekeyBatch; k, v = c.Next() {
+			n++
+			s.after = append([]byte(nil), k...)
+			if v == nil {
+				// a nested bucket
+				continue
+			}
+			if bytes.Equal(s.bkt, cfgBkt) {
+				if bytes.Equal(k, rekeyKey) {
+					continue
+				}
+				if bytes.Equal(k, scrubKey) {
+					// the scrubber's place is a sealed key, it starts over
+					recs = append(recs, record{k: s.after})
+					continue
+				}
+			}
+			nk, nv := rekeyRecord(s.old, key, k, v)
+			if nk != nil {
+				recs = append(recs, record{s.after, nk, append([]byte(nil), nv...)})
+			}
+		}
+		done = k == nil
+		for _, r := range recs {
+			if r.nk == nil || !bytes.Equal(r.k, r.nk) {
+				if err := bkt.Delete(r.k); err != nil {
+					return err
+				}
+			}
+			if r.nk != nil {
+				if err := bkt.Put(r.nk, r.nv); err != nil {
+					return err
+				}
+			}
+		}
+		return f.saveRekeyTx(tx, s)
+	})
+	return done, err
+}
+
+// rekeyRecord returns a record under the new key, or nil if it does not need to
+// change. A key that isn't sealed, like the key validation record, keeps its
+// name. Anything that was not sealed with the old key, like a quarantined
+// record that can't be decrypted or a bucket of another application sharing the
+// DB, is left as it is.
+func rekeyRecord(old, key *crypto.Symmetric, k, v []byte) ([]byte, []byte) {
+	if _, err := key.NonceOpen(k, zeroNonce); err == nil {
+		return nil, nil
+	}
+	nk, nv := k, v
+	if pk, err := old.NonceOpen(k, zeroNonce); err == nil {
+		nk = seal(key, pk)
+	}
+	if _, err := key.Open(v); err != nil {
+		if pv, err := old.Open(v); err == nil {
+			nv = key.Seal(pv, nil)
+		}
+	}
+	if bytes.Equal(nk, k) && bytes.Equal(nv, v) {
+		return nil, nil
+	}
+	return nk, nv
+}
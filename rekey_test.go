@@ -0,0 +1,272 @@
+package merkle
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+// rekeyForest fills a Forest with a tree, a pinned tree with meta data, an
+// inline tree, a sapling and a value.
+func rekeyForest(t *testing.T, f *Forest) ([]*Tree, [][]byte) {
+	data := [][]byte{
+		make([]byte, BlockSize*3+100),
+		make([]byte, BlockSize*2),
+		make([]byte, 100),
+		make([]byte, BlockSize*4),
+	}
+	var trees []*Tree
+	for i, d := range data {
+		rand.Read(d)
+		if i == 3 {
+			break
+		}
+		opts := &TreeOptions{}
+		if i == 1 {
+			opts.Meta = &TreeMeta{Name: "pinned"}
+		}
+		tr, err := f.BuildTreeWithOptions(bytes.NewReader(d), opts)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		trees = append(trees, tr)
+	}
+	assert.NoError(t, f.Pin(trees[1].Digest()))
+
+	src := OpenMemory(crypto.RandomSymmetric())
+	srcTr, err := src.BuildTree(bytes.NewReader(data[3]))
+	assert.NoError(t, err)
+	sapling := f.New(srcTr.Digest(), srcTr.leaves)
+	vc, leaf, err := srcTr.GetLeaf(1)
+	assert.NoError(t, err)
+	assert.NoError(t, sapling.AddLeaf(vc, leaf, 1))
+	trees = append(trees, sapling)
+
+	assert.NoError(t, f.SetValue([]byte("bkt"), []byte("key"), []byte("value")))
+	return trees, data
+}
+
+// assertRekeyed checks that everything in the Forest can be read and that no
+// leaf or branch is still named with the old key.
+func assertRekeyed(t *testing.T, f *Forest, old *crypto.Symmetric, trees []*Tree, data [][]byte) {
+	for i, tr := range trees[:3] {
+		tr := f.GetTree(tr.Digest())
+		if !assert.NotNil(t, tr) {
+			continue
+		}
+		out, err := tr.ReadAll()
+		assert.NoError(t, err)
+		assert.Equal(t, data[i], out)
+	}
+	assert.True(t, f.IsPinned(trees[1].Digest()))
+	assert.Equal(t, "pinned", f.GetTree(trees[1].Digest()).Meta().Name)
+	sapling := f.GetTree(trees[3].Digest())
+	if assert.NotNil(t, sapling) {
+		assert.False(t, sapling.Complete())
+		_, leaf, err := sapling.GetLeaf(1)
+		assert.NoError(t, err)
+		assert.Equal(t, data[3][BlockSize:BlockSize*2], leaf)
+	}
+	v, err := f.GetValue([]byte("bkt"), []byte("key"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), v)
+
+	r, err := f.Verify(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, r.OK())
+
+	f.meta.View(func(tx MetaTx) error {
+		c := tx.Bucket(branchBkt).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			_, err := old.NonceOpen(k, zeroNonce)
+			assert.Error(t, err)
+		}
+		return nil
+	})
+	if l, ok := f.leaves.(LeafLister); ok {
+		l.Keys(func(k []byte) error {
+			_, err := f.key().NonceOpen(k, zeroNonce)
+			assert.NoError(t, err)
+			return nil
+		})
+	}
+}
+
+func TestRekey(t *testing.T) {
+	dirStr := "TestRekey"
+	os.RemoveAll(dirStr)
+	key := crypto.RandomSymmetric()
+	f, err := Open(dirStr, key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	trees, data := rekeyForest(t, f)
+	stats := f.Stats()
+	usage := f.Usage("")
+
+	newKey := crypto.RandomSymmetric()
+	assert.NoError(t, f.Rekey(newKey))
+	assert.False(t, f.Rekeying())
+	assertRekeyed(t, f, key, trees, data)
+	assertRefsConsistent(t, f)
+	assertStatsConsistent(t, f)
+	assert.Equal(t, stats, f.Stats())
+	assert.Equal(t, usage, f.Usage(""))
+
+	// the Forest can still be written
+	tr, err := f.BuildTree(bytes.NewReader(data[0][:BlockSize]))
+	assert.NoError(t, err)
+	assert.NotNil(t, tr)
+	f.Close()
+
+	_, err = Open(dirStr, key)
+	assert.Error(t, err)
+	f, err = Open(dirStr, newKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assertRekeyed(t, f, key, trees, data)
+	f.Close()
+	os.RemoveAll(dirStr)
+}
+
+func TestRekeyPackStore(t *testing.T) {
+	dirStr := "TestRekeyPackStore"
+	os.RemoveAll(dirStr)
+	assert.NoError(t, os.MkdirAll(dirStr, 0777))
+	key := crypto.RandomSymmetric()
+	f, err := OpenWithStore(dirStr, key, NewPackStore(dirStr, 0))
+	if !assert.NoError(t, err) {
+		return
+	}
+	trees, data := rekeyForest(t, f)
+	assert.NoError(t, f.Rekey(crypto.RandomSymmetric()))
+	assertRekeyed(t, f, key, trees, data)
+	f.Close()
+	os.RemoveAll(dirStr)
+}
+
+func TestRekeyResume(t *testing.T) {
+	key := crypto.RandomSymmetric()
+	f, err := newForest(key, newMemMeta(), newMemStore(), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	trees, data := rekeyForest(t, f)
+
+	// interrupt a Rekey after the leaves and part of the buckets are moved
+	newKey := crypto.RandomSymmetric()
+	s := &rekeyState{old: key}
+	assert.NoError(t, f.meta.Update(func(tx MetaTx) error {
+		return tx.Bucket(cfgBkt).Put(rekeyKey, newKey.Seal(s.marshal(), nil))
+	}))
+	f.setKeys(newKey, key)
+	assert.NoError(t, f.rekeyLeaves(key))
+	s.leaves = true
+	for _, b := range [][]byte{branchBkt, inlineBkt, treeBkt} {
+		s.bkt, s.after = b, nil
+		_, err = f.rekeyBatchOf(s)
+		assert.NoError(t, err)
+	}
+
+	_, err = newForest(key, f.meta, f.leaves, nil)
+	assert.Equal(t, ErrRekeying, err)
+	f, err = newForest(newKey, f.meta, f.leaves, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, f.Rekeying())
+
+	// readable but not writable
+	for i, tr := range trees[:3] {
+		out, err := f.GetTree(tr.Digest()).ReadAll()
+		assert.NoError(t, err)
+		assert.Equal(t, data[i], out)
+	}
+	assert.True(t, f.IsPinned(trees[1].Digest()))
+	v, err := f.GetValue([]byte("bkt"), []byte("key"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), v)
+	_, err = f.BuildTree(bytes.NewReader(data[0]))
+	assert.Equal(t, ErrRekeying, err)
+	assert.Equal(t, ErrRekeying, f.SetValue([]byte("bkt"), []byte("key"), nil))
+	assert.Equal(t, ErrRekeying, f.Pin(trees[0].Digest()))
+	assert.Equal(t, ErrRekeying, f.DeleteTree(trees[0].Digest()))
+
+	assert.Equal(t, ErrRekeying, f.Rekey(crypto.RandomSymmetric()))
+	assert.NoError(t, f.Rekey(newKey))
+	assert.False(t, f.Rekeying())
+	assertRekeyed(t, f, key, trees, data)
+	assertRefsConsistent(t, f)
+	assertStatsConsistent(t, f)
+	assert.NoError(t, f.SetValue([]byte("bkt"), []byte("key"), []byte("new")))
+}
+
+// syncKeysStore checks that every leaf that is written has been flushed with
+// SyncKeys before a leaf is deleted.
+type syncKeysStore struct {
+	*memStore
+	t        *testing.T
+	unsynced map[string]bool
+	synced   int
+}
+
+func (s *syncKeysStore) SetDurability(d Durability) {}
+func (s *syncKeysStore) Sync() error                { return nil }
+
+func (s *syncKeysStore) SyncKeys(keys [][]byte) error {
+	for _, k := range keys {
+		delete(s.unsynced, string(k))
+		s.synced++
+	}
+	return nil
+}
+
+func (s *syncKeysStore) Put(key, leaf []byte) error {
+	s.unsynced[string(key)] = true
+	return s.memStore.Put(key, leaf)
+}
+
+func (s *syncKeysStore) Delete(key []byte) error {
+	assert.Len(s.t, s.unsynced, 0)
+	return s.memStore.Delete(key)
+}
+
+func TestRekeySyncsLeaves(t *testing.T) {
+	store := &syncKeysStore{
+		memStore: newMemStore(),
+		t:        t,
+		unsynced: make(map[string]bool),
+	}
+	key := crypto.RandomSymmetric()
+	f, err := newForest(key, newMemMeta(), store, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f.SetDurability(SyncNone)
+	trees, data := rekeyForest(t, f)
+	store.unsynced = make(map[string]bool)
+	leaves := len(store.leaves)
+
+	assert.NoError(t, f.Rekey(crypto.RandomSymmetric()))
+	assert.Equal(t, leaves, store.synced)
+	assertRekeyed(t, f, key, trees, data)
+}
+
+func TestRekeyUnreadable(t *testing.T) {
+	f := OpenMemory(crypto.RandomSymmetric())
+	trees, _ := rekeyForest(t, f)
+	f.meta.Update(func(tx MetaTx) error {
+		return tx.Bucket(branchBkt).Put(f.sealDigest(trees[0].Digest()), []byte("garbage"))
+	})
+	assert.Equal(t, ErrUnreadable, f.Rekey(crypto.RandomSymmetric()))
+	assert.False(t, f.Rekeying())
+
+	_, err := f.Repair(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, f.Rekey(crypto.RandomSymmetric()))
+}
@@ -0,0 +1,195 @@
+package merkle
+
+import (
+	"context"
+	"github.com/dist-ribut-us/crypto"
+)
+
+// Records that Repair finds corrupt are moved to the quarantineBkt, still
+// encrypted, so they can be inspected later.
+var quarantineBkt = []byte("q")
+
+// Repair runs Verify and fixes what it finds. Each corrupt leaf, branch and
+// tree record is moved to quarantine. The leaves that can no longer be read are
+// marked incomplete, turning the tree back into a sapling so they can be added
+// again with AddLeaf. A tree whose record is corrupt can't be recovered and is
+// removed. Finally GC is run to remove anything that is no longer reachable.
+// Quotas are not checked for trees that are turned back into saplings. A leaf
+// the LeafStore returned an error for is reported but not repaired, the data
+// may be intact once the LeafStore can be read again. The returned report
+// lists the problems that were found.
+//
+// Repair does not need to be called to fix a tree that is read or checked by a
+// Scrubber, that tree is repaired when the problem is found.
+func (f *Forest) Repair(ctx context.Context) (*VerifyReport, error) {
+	if err := f.writable(); err != nil {
+		return nil, err
+	}
+	f.treeMux.Lock()
+	defer f.treeMux.Unlock()
+	r, err := f.verify(ctx)
+	if err != nil || r.OK() {
+		return r, err
+	}
+	return r, f.repair(r.Problems)
+}
+
+// repairTree checks a single tree and repairs it if there are problems.
+func (f *Forest) repairTree(ctx context.Context, d *crypto.Digest) (*VerifyReport, error) {
+	if err := f.writable(); err != nil {
+		return nil, err
+	}
+	f.treeMux.Lock()
+	defer f.treeMux.Unlock()
+	v := newVerifier(f)
+	if err := v.tree(ctx, d); err != nil || v.report.OK() {
+		return v.report, err
+	}
+	return v.report, f.repair(v.report.Problems)
+}
+
+// repair quarantines the records and demotes the trees in the problems found
+// by a verifier. Must be called while holding the write lock.
+func (f *Forest) repair(problems []Problem) error {
+	// leaves are read and removed from the LeafStore outside the transaction
+	leafKeys := make(map[string][]byte)
+	for _, p := range problems {
+		if p.Kind != DecryptFailed && p.Kind != DigestMismatch {
+			continue
+		}
+		cd := f.sealDigest(p.Node)
+		if b, err := f.leaves.Get(cd); err == nil {
+			leafKeys[string(cd)] = b
+		}
+	}
+
+	err := f.meta.Update(func(tx MetaTx) error {
+		q, err := tx.CreateBucketIfNotExists(quarantineBkt)
+		if err != nil {
+			return err
+		}
+		quarantine := func(bkt MetaBucket, key []byte) error {
+			if v := bkt.Get(key); v != nil {
+				if err := q.Put(key, v); err != nil {
+					return err
+				}
+				return bkt.Delete(key)
+			}
+			return nil
+		}
+		// tree records with a key that can't be decrypted have no digest
+		_, bad := f.treeKeys(tx)
+		for _, key := range bad {
+			if err = quarantine(tx.Bucket(treeBkt), key); err != nil {
+				return err
+			}
+		}
+		// the usage of a tree whose record is lost can only be rebuilt
+		lost := len(bad) > 0
+		trees := make(map[crypto.Digest]*Tree)
+		for _, p := range problems {
+			if p.Node == nil {
+				continue
+			}
+			key := f.sealDigest(p.Node)
+			switch p.Kind {
+			case ReadFailed:
+				// the LeafStore may only be unavailable for now
+				continue
+			case BadTreeRecord:
+				if err = quarantine(tx.Bucket(treeBkt), key); err != nil {
+					return err
+				}
+				if err = tx.Bucket(accessBkt).Delete(key); err != nil {
+					return err
+				}
+				if err = tx.Bucket(pinBkt).Delete(key); err != nil {
+					return err
+				}
+				lost = true
+				continue
+			case DecryptFailed, DigestMismatch:
+				if err = quarantine(tx.Bucket(branchBkt), key); err != nil {
+					return err
+				}
+				if err = quarantine(tx.Bucket(inlineBkt), key); err != nil {
+					return err
+				}
+				if b, ok := leafKeys[string(key)]; ok {
+					if err = q.Put(key, b); err != nil {
+						return err
+					}
+				}
+			}
+			t, ok := trees[*p.Tree]
+			if !ok {
+				if t = f.getTreeTx(tx, p.Tree); t == nil {
+					continue
+				}
+				trees[*p.Tree] = t
+			}
+			t.demote(p.Start, p.End)
+		}
+		for _, t := range trees {
+			if err = f.saveTreeTx(tx, t, false); err != nil {
+				return err
+			}
+		}
+		if lost {
+			return f.rebuildUsage(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	f.leafCache.purge()
+	f.branchCache.purge()
+	for key := range leafKeys {
+		if err = f.leaves.Delete([]byte(key)); err != nil {
+			return err
+		}
+	}
+	// if a record of another tree can't be read, what this left unreachable
+	// is removed once that tree is repaired
+	if _, err = f.gc(); err == ErrUnreadable {
+		err = nil
+	}
+	return err
+}
+
+// demote marks the leaves from start to end as incomplete.
+func (t *Tree) demote(start, end uint32) {
+	if t.complete {
+		t.complete = false
+		t.leavesComplete = make([]bool, t.leaves)
+		for i := range t.leavesComplete {
+			t.leavesComplete[i] = true
+		}
+	}
+	for i := start; i < end && i < t.leaves; i++ {
+		t.leavesComplete[i] = false
+	}
+}
+
+// Quarantined returns the digests of the records moved to quarantine by
+// Repair.
+func (f *Forest) Quarantined() ([]*crypto.Digest, error) {
+	var ds []*crypto.Digest
+	err := f.meta.View(func(tx MetaTx) error {
+		bkt := tx.Bucket(quarantineBkt)
+		if bkt == nil {
+			return nil
+		}
+		c := bkt.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			d, err := f.openKey(k, zeroNonce)
+			if err != nil {
+				return err
+			}
+			ds = append(ds, crypto.DigestFromSlice(d))
+		}
+		return nil
+	})
+	return ds, err
+}
@@ -0,0 +1,173 @@
+package merkle
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	f, trees, data := corruptForest(t)
+
+	r, err := f.Repair(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, r.Problems, 5)
+	assertRefsConsistent(t, f)
+	assertStatsConsistent(t, f)
+
+	r, err = f.Verify(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, r.OK())
+
+	q, err := f.Quarantined()
+	assert.NoError(t, err)
+	assert.Len(t, q, 3)
+	assert.Nil(t, f.GetTree(trees[5].Digest()))
+
+	missing := map[int][]int{
+		1: {1},
+		2: {2},
+		3: {0},
+		4: {2, 3},
+	}
+	src := OpenMemory(crypto.RandomSymmetric())
+	for i, idxs := range missing {
+		tr := f.GetTree(trees[i].Digest())
+		if !assert.NotNil(t, tr) {
+			continue
+		}
+		assert.False(t, tr.Complete())
+		for j, c := range tr.leavesComplete {
+			assert.Equal(t, !contains(idxs, j), c)
+		}
+
+		srcTr, err := src.BuildTree(bytes.NewReader(data[i]))
+		assert.NoError(t, err)
+		for _, j := range idxs {
+			vc, leaf, err := srcTr.GetLeaf(j)
+			assert.NoError(t, err)
+			assert.NoError(t, tr.AddLeaf(vc, leaf, j))
+		}
+		assert.True(t, tr.Complete())
+		out, err := tr.ReadAll()
+		assert.NoError(t, err)
+		assert.Equal(t, data[i], out)
+	}
+
+	r, err = f.Verify(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, r.OK())
+	assertRefsConsistent(t, f)
+	assertStatsConsistent(t, f)
+}
+
+func contains(is []int, i int) bool {
+	for _, v := range is {
+		if v == i {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRepairOnRead(t *testing.T) {
+	f, trees, data := corruptForest(t)
+
+	// reading a damaged tree repairs it
+	for _, i := range []int{1, 2, 3} {
+		_, err := trees[i].ReadAll()
+		assert.Equal(t, ErrCorrupt, err)
+		assert.False(t, trees[i].Complete())
+	}
+	_, _, err := trees[4].GetLeaf(3)
+	assert.Equal(t, ErrCorrupt, err)
+	assert.False(t, trees[4].Complete())
+	_, _, err = trees[1].GetLeaf(1)
+	assert.Equal(t, ErrIncomplete, err)
+	_, leaf, err := trees[1].GetLeaf(0)
+	assert.NoError(t, err)
+	assert.Equal(t, data[1][:BlockSize], leaf)
+
+	q, err := f.Quarantined()
+	assert.NoError(t, err)
+	assert.Len(t, q, 2)
+	assert.Equal(t, int64(4), f.Stats().IncompleteTrees)
+
+	// a tree that was fine is left alone
+	out, err := trees[0].ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data[0], out)
+
+	// only the tree record that can't be read is left for Repair
+	r, err := f.Repair(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, r.Problems, 1)
+	assertRefsConsistent(t, f)
+	assertStatsConsistent(t, f)
+}
+
+// failStore is a LeafStore whose Get fails while err is set.
+type failStore struct {
+	*memStore
+	mux sync.Mutex
+	err error
+}
+
+func (s *failStore) fail(err error) {
+	s.mux.Lock()
+	s.err = err
+	s.mux.Unlock()
+}
+
+func (s *failStore) Get(key []byte) ([]byte, error) {
+	s.mux.Lock()
+	err := s.err
+	s.mux.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return s.memStore.Get(key)
+}
+
+func TestRepairReadFailed(t *testing.T) {
+	store := &failStore{memStore: newMemStore()}
+	f, err := newForest(crypto.RandomSymmetric(), newMemMeta(), store, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	data := make([]byte, BlockSize*3)
+	rand.Read(data)
+	tr, err := f.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	leaves := len(store.leaves)
+
+	// a LeafStore that can't be reached does not make the tree a sapling
+	testErr := errors.String("test error")
+	store.fail(testErr)
+	r, err := f.Repair(context.Background())
+	assert.NoError(t, err)
+	if assert.Len(t, r.Problems, leaves) {
+		for _, p := range r.Problems {
+			assert.Equal(t, ReadFailed, p.Kind)
+			assert.Equal(t, testErr, p.Err)
+		}
+	}
+	assert.True(t, f.GetTree(tr.Digest()).Complete())
+	q, err := f.Quarantined()
+	assert.NoError(t, err)
+	assert.Len(t, q, 0)
+	assert.Len(t, store.leaves, leaves)
+
+	store.fail(nil)
+	out, err := f.GetTree(tr.Digest()).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+}
@@ -0,0 +1,220 @@
+package merkle
+
+import (
+	"bytes"
+	"context"
+	"github.com/dist-ribut-us/crypto"
+	"time"
+)
+
+// DefaultScrubRate is the default number of bytes per second read by a
+// Scrubber.
+const DefaultScrubRate = 1 << 20
+
+// DefaultScrubPause is the default time a Scrubber waits after checking every
+// tree before it starts again.
+const DefaultScrubPause = time.Hour
+
+// scrubKey is where the last tree checked by the Scrubber is saved.
+var scrubKey = []byte("scrub")
+
+// ScrubOptions configure a Scrubber.
+type ScrubOptions struct {
+	// Rate limits the bytes read per second. Defaults to DefaultScrubRate.
+	Rate int64
+	// Pause is how long to wait after a full pass over the Forest or an error.
+	// Defaults to DefaultScrubPause.
+	Pause time.Duration
+	// OnProblem is called with each problem found.
+	OnProblem func(Problem)
+	// OnError is called if checking a tree fails, including when the
+	// LeafStore returns an error for a leaf. The Scrubber waits for Pause
+	// before it tries again.
+	OnError func(error)
+}
+
+// Scrubber checks the trees in a Forest in the background, one at a time, the
+// same way as Verify. It saves its progress after each tree, so after the
+// Forest is reopened a new Scrubber carries on where the last one stopped.
+// Trees are checked without blocking writes. If a problem is found, the tree is
+// checked again while holding off writes and repaired as Repair would before
+// the problem is reported. If the Forest can't be written, the problems are
+// only reported.
+type Scrubber struct {
+	f      *Forest
+	opts   ScrubOptions
+	cancel func()
+	done   chan struct{}
+	start  time.Time
+	read   int64
+}
+
+// StartScrubber starts a Scrubber. It is stopped by calling Stop or closing the
+// Forest.
+func (f *Forest) StartScrubber(opts *ScrubOptions) *Scrubber {
+	s := &Scrubber{
+		f:    f,
+		done: make(chan struct{}),
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.Rate <= 0 {
+		s.opts.Rate = DefaultScrubRate
+	}
+	if s.opts.Pause <= 0 {
+		s.opts.Pause = DefaultScrubPause
+	}
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	if f.stop == nil {
+		f.stop = make(chan struct{})
+	}
+	stop := f.stop
+	f.bg.Add(1)
+	go func() {
+		defer f.bg.Done()
+		defer close(s.done)
+		go func() {
+			select {
+			case <-stop:
+				s.cancel()
+			case <-ctx.Done():
+			}
+		}()
+		s.run(ctx)
+	}()
+	return s
+}
+
+// Stop stops the Scrubber and waits for it to finish.
+func (s *Scrubber) Stop() {
+	s.cancel()
+	<-s.done
+}
+
+func (s *Scrubber) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		more, err := s.step(ctx)
+		if err != nil && ctx.Err() == nil && s.opts.OnError != nil {
+			s.opts.OnError(err)
+		}
+		if err == nil && more {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(s.opts.Pause):
+		}
+	}
+}
+
+// step checks the tree after the last one checked. It returns false when it
+// has reached the end of the Forest.
+func (s *Scrubber) step(ctx context.Context) (bool, error) {
+	f := s.f
+	if f.Rekeying() {
+		// the saved progress is dropped by Rekey, wait for it to finish
+		return false, nil
+	}
+	var d *crypto.Digest
+	var key []byte
+	err := f.meta.View(func(tx MetaTx) error {
+		var last []byte
+		if cfg := tx.Bucket(cfgBkt); cfg != nil {
+			last, _ = f.open(cfg.Get(scrubKey))
+		}
+		c := tx.Bucket(treeBkt).Cursor()
+		var k []byte
+		if last == nil {
+			k, _ = c.First()
+		} else if k, _ = c.Seek(last); bytes.Equal(k, last) {
+			k, _ = c.Next()
+		}
+		for ; k != nil; k, _ = c.Next() {
+			if bytes.Equal(k, validateKey) {
+				continue
+			}
+			if dig, err := f.openKey(k, zeroNonce); err == nil && len(dig) == crypto.DigestLength {
+				d, key = crypto.DigestFromSlice(dig), append([]byte(nil), k...)
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if d != nil {
+		v := newVerifier(f)
+		v.pace = s.pace
+		if err = v.tree(ctx, d); err != nil {
+			return false, err
+		}
+		if !v.report.OK() {
+			if err = s.confirm(ctx, d, v.report); err != nil {
+				return false, err
+			}
+		}
+	}
+	if f.writable() == nil {
+		err = f.meta.Update(func(tx MetaTx) error {
+			if key == nil {
+				return tx.Bucket(cfgBkt).Delete(scrubKey)
+			}
+			return tx.Bucket(cfgBkt).Put(scrubKey, f.key().Seal(key, nil))
+		})
+	}
+	return d != nil, err
+}
+
+// confirm reports the problems found in a tree. If any of them are corruption,
+// the tree is checked again, with the lock held so it can't be changed, and
+// repaired first. A leaf the LeafStore failed to read is not corruption, the
+// LeafStore may only be unavailable for now, so its error is returned and the
+// Scrubber backs off and checks the tree again.
+func (s *Scrubber) confirm(ctx context.Context, d *crypto.Digest, r *VerifyReport) error {
+	var err error
+	if r.corrupt() {
+		if s.f.writable() == nil {
+			r, err = s.f.repairTree(ctx, d)
+		} else {
+			s.f.treeMux.RLock()
+			v := newVerifier(s.f)
+			err = v.tree(ctx, d)
+			s.f.treeMux.RUnlock()
+			r = v.report
+		}
+	}
+	if r == nil {
+		return err
+	}
+	if s.opts.OnProblem != nil {
+		for _, p := range r.Problems {
+			s.opts.OnProblem(p)
+		}
+	}
+	if err == nil {
+		err = r.readErr()
+	}
+	return err
+}
+
+// pace sleeps as needed to keep the bytes read under the Rate.
+func (s *Scrubber) pace(ctx context.Context, n int) error {
+	now := time.Now()
+	if s.start.IsZero() || now.Sub(s.start) > time.Second {
+		s.start, s.read = now, 0
+	}
+	s.read += int64(n)
+	wait := time.Duration(s.read*int64(time.Second)/s.opts.Rate) - now.Sub(s.start)
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
@@ -0,0 +1,278 @@
+package merkle
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScrubber(t *testing.T) {
+	f, _, _ := corruptForest(t)
+
+	problems := make(chan Problem, 10)
+	s := f.StartScrubber(&ScrubOptions{
+		Rate:      1 << 30,
+		OnProblem: func(p Problem) { problems <- p },
+	})
+	kinds := make(map[ProblemKind]int)
+	timeout := time.After(time.Second * 5)
+	for i := 0; i < 5; i++ {
+		select {
+		case p := <-problems:
+			kinds[p.Kind]++
+		case <-timeout:
+			t.Error("timed out")
+			i = 5
+		}
+	}
+	s.Stop()
+	assert.Equal(t, map[ProblemKind]int{
+		MissingLeaf:    1,
+		DigestMismatch: 1,
+		DecryptFailed:  1,
+		MissingBranch:  1,
+		BadTreeRecord:  1,
+	}, kinds)
+
+	// the problems were repaired as they were found
+	r, err := f.Verify(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, r.OK())
+	assertRefsConsistent(t, f)
+	assertStatsConsistent(t, f)
+}
+
+func TestScrubberProgress(t *testing.T) {
+	f := OpenMemory(crypto.RandomSymmetric())
+	for i := 0; i < 3; i++ {
+		data := make([]byte, 1000)
+		rand.Read(data)
+		_, err := f.BuildTree(bytes.NewReader(data))
+		assert.NoError(t, err)
+	}
+
+	// each Scrubber carries on from the last
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		s := &Scrubber{f: f, opts: ScrubOptions{Rate: 1 << 30}}
+		more, err := s.step(ctx)
+		assert.NoError(t, err)
+		assert.True(t, more)
+	}
+	s := &Scrubber{f: f, opts: ScrubOptions{Rate: 1 << 30}}
+	more, err := s.step(ctx)
+	assert.NoError(t, err)
+	assert.False(t, more)
+	f.meta.View(func(tx MetaTx) error {
+		assert.Nil(t, tx.Bucket(cfgBkt).Get(scrubKey))
+		return nil
+	})
+	more, err = s.step(ctx)
+	assert.NoError(t, err)
+	assert.True(t, more)
+}
+
+func TestScrubberPace(t *testing.T) {
+	s := &Scrubber{opts: ScrubOptions{Rate: 1000}}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, s.pace(context.Background(), 50))
+	}
+	assert.True(t, time.Since(start) >= time.Millisecond*100)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, s.pace(ctx, 1000))
+}
+
+func TestScrubberResume(t *testing.T) {
+	dirStr := "TestScrubberResume"
+	os.RemoveAll(dirStr)
+	key := crypto.RandomSymmetric()
+	f, err := Open(dirStr, key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for i := 0; i < 3; i++ {
+		data := make([]byte, 1000)
+		rand.Read(data)
+		_, err := f.BuildTree(bytes.NewReader(data))
+		assert.NoError(t, err)
+	}
+	var keys [][]byte
+	f.meta.View(func(tx MetaTx) error {
+		c := tx.Bucket(treeBkt).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if !bytes.Equal(k, validateKey) {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+		}
+		return nil
+	})
+	scrubbed := func(f *Forest) []byte {
+		var v []byte
+		f.meta.View(func(tx MetaTx) error {
+			v, _ = f.open(tx.Bucket(cfgBkt).Get(scrubKey))
+			return nil
+		})
+		return v
+	}
+
+	// the second Scrubber starts on the tree after the one the first checked
+	ctx := context.Background()
+	s := &Scrubber{f: f, opts: ScrubOptions{Rate: 1 << 30}}
+	_, err = s.step(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, keys[0], scrubbed(f))
+	f.Close()
+
+	f, err = Open(dirStr, key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, keys[0], scrubbed(f))
+	s = &Scrubber{f: f, opts: ScrubOptions{Rate: 1 << 30}}
+	_, err = s.step(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, keys[1], scrubbed(f))
+	f.Close()
+	os.RemoveAll(dirStr)
+}
+
+// failMeta is a MetaStore that fails every transaction once fail is called.
+type failMeta struct {
+	*memMeta
+	mux sync.Mutex
+	err error
+}
+
+func (m *failMeta) fail(err error) {
+	m.mux.Lock()
+	m.err = err
+	m.mux.Unlock()
+}
+
+func (m *failMeta) failed() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.err
+}
+
+func (m *failMeta) View(fn func(tx MetaTx) error) error {
+	if err := m.failed(); err != nil {
+		return err
+	}
+	return m.memMeta.View(fn)
+}
+
+func (m *failMeta) Update(fn func(tx MetaTx) error) error {
+	if err := m.failed(); err != nil {
+		return err
+	}
+	return m.memMeta.Update(fn)
+}
+
+func TestScrubberError(t *testing.T) {
+	meta := &failMeta{memMeta: newMemMeta()}
+	f, err := newForest(crypto.RandomSymmetric(), meta, newMemStore(), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	testErr := errors.String("test error")
+	meta.fail(testErr)
+
+	// the error is reported and the Scrubber waits before trying again
+	errs := make(chan error, 10)
+	s := f.StartScrubber(&ScrubOptions{
+		OnError: func(err error) { errs <- err },
+	})
+	select {
+	case err := <-errs:
+		assert.Equal(t, testErr, err)
+	case <-time.After(time.Second * 5):
+		t.Error("timed out")
+	}
+	time.Sleep(time.Millisecond * 50)
+	s.Stop()
+	assert.Len(t, errs, 0)
+}
+
+func TestScrubberPaceBytes(t *testing.T) {
+	f := OpenMemory(crypto.RandomSymmetric())
+	small, err := f.BuildTree(bytes.NewReader(make([]byte, 100)))
+	assert.NoError(t, err)
+	data := make([]byte, BlockSize*2+10)
+	rand.Read(data)
+	tr, err := f.BuildTree(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	// the bytes of the branches and leaves read are counted, an inline leaf is
+	// smaller than a block
+	var read int
+	v := newVerifier(f)
+	v.pace = func(ctx context.Context, n int) error {
+		read += n
+		return nil
+	}
+	assert.NoError(t, v.tree(context.Background(), small.Digest()))
+	assert.Equal(t, inlineClass(100)+overhead, read)
+
+	read = 0
+	assert.NoError(t, v.tree(context.Background(), tr.Digest()))
+	branch := crypto.DigestLength*2 + 1 + overhead
+	assert.Equal(t, 3*(BlockSize+overhead)+2*branch, read)
+}
+
+func TestScrubberReadFailed(t *testing.T) {
+	store := &failStore{memStore: newMemStore()}
+	f, err := newForest(crypto.RandomSymmetric(), newMemMeta(), store, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	data := make([]byte, BlockSize*3)
+	rand.Read(data)
+	tr, err := f.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	testErr := errors.String("test error")
+	store.fail(testErr)
+
+	// the problem and the error are reported and the tree is left alone
+	problems := make(chan Problem, 10)
+	errs := make(chan error, 10)
+	s := f.StartScrubber(&ScrubOptions{
+		Rate:      1 << 30,
+		OnProblem: func(p Problem) { problems <- p },
+		OnError:   func(err error) { errs <- err },
+	})
+	select {
+	case err := <-errs:
+		assert.Equal(t, testErr, err)
+	case <-time.After(time.Second * 5):
+		t.Error("timed out")
+	}
+	s.Stop()
+	assert.True(t, len(problems) > 0)
+	for len(problems) > 0 {
+		assert.Equal(t, ReadFailed, (<-problems).Kind)
+	}
+	assert.True(t, f.GetTree(tr.Digest()).Complete())
+
+	// the tree is checked again after the pause
+	f.meta.View(func(tx MetaTx) error {
+		assert.Nil(t, tx.Bucket(cfgBkt).Get(scrubKey))
+		return nil
+	})
+	store.fail(nil)
+	out, err := f.GetTree(tr.Digest()).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+}
@@ -0,0 +1,191 @@
+package merkle
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/serial"
+)
+
+// Stats describe what is stored in a Forest. They are kept up to date by each
+// write so they don't require a scan.
+type Stats struct {
+	Trees           int64
+	CompleteTrees   int64
+	IncompleteTrees int64
+	// Leaves and Branches are the number of distinct leaves and branches.
+	Leaves   int64
+	Branches int64
+	// LogicalBytes is the total length of the complete trees.
+	LogicalBytes int64
+	// PhysicalBytes is approximate, every leaf is counted as a full block
+	// with the encryption overhead.
+	PhysicalBytes int64
+	// SaplingBytes is the bytes of leaves held by incomplete trees.
+	SaplingBytes int64
+	// DedupRatio is the number of leaves used by all the trees divided by the
+	// number of distinct leaves. It is 1 if no leaves are shared.
+	DedupRatio float64
+}
+
+var statsKey = []byte("stats")
+
+// The counters saved in the statsKey record
+const (
+	statTrees = iota
+	statComplete
+	statLeaves
+	statBranches
+	statLogical
+	statSapling
+	statTreeLeaves
+	statCount
+)
+
+type statCounters [statCount]int64
+
+func (s *statCounters) add(o statCounters, sign int64) {
+	for i, v := range o {
+		s[i] += sign * v
+	}
+}
+
+// treeStats is what a tree record adds to the counters.
+func treeStats(t *Tree) statCounters {
+	var s statCounters
+	if t == nil {
+		return s
+	}
+	s[statTrees] = 1
+	if t.complete {
+		s[statComplete] = 1
+		s[statLogical] = int64(t.Len())
+		s[statTreeLeaves] = int64(t.leaves)
+		return s
+	}
+	for _, c := range t.leavesComplete {
+		if c {
+			s[statTreeLeaves]++
+		}
+	}
+	s[statSapling] = s[statTreeLeaves] * int64(t.f.blockSize)
+	return s
+}
+
+func negStats(s statCounters) statCounters {
+	var out statCounters
+	out.add(s, -1)
+	return out
+}
+
+func (f *Forest) getStatsTx(tx MetaTx) statCounters {
+	var s statCounters
+	cfg := tx.Bucket(cfgBkt)
+	if cfg == nil {
+		return s
+	}
+	v, err := f.open(cfg.Get(statsKey))
+	if err != nil || len(v) != statCount*8 {
+		return s
+	}
+	for i := range s {
+		s[i] = int64(serial.UnmarshalUint64(v[i*8:]))
+	}
+	return s
+}
+
+func (f *Forest) setStatsTx(tx MetaTx, s statCounters) error {
+	v := make([]byte, statCount*8)
+	for i, c := range s {
+		serial.MarshalUint64(uint64(c), v[i*8:])
+	}
+	return tx.Bucket(cfgBkt).Put(statsKey, f.key().Seal(v, nil))
+}
+
+// addStatsTx adds delta to the saved counters.
+func (f *Forest) addStatsTx(tx MetaTx, delta statCounters) error {
+	if delta == (statCounters{}) {
+		return nil
+	}
+	s := f.getStatsTx(tx)
+	s.add(delta, 1)
+	return f.setStatsTx(tx, s)
+}
+
+func (f *Forest) addStatTx(tx MetaTx, stat int, n int64) error {
+	var delta statCounters
+	delta[stat] = n
+	return f.addStatsTx(tx, delta)
+}
+
+// Stats returns the statistics for the Forest.
+func (f *Forest) Stats() Stats {
+	var s statCounters
+	f.meta.View(func(tx MetaTx) error {
+		s = f.getStatsTx(tx)
+		return nil
+	})
+	out := Stats{
+		Trees:           s[statTrees],
+		CompleteTrees:   s[statComplete],
+		IncompleteTrees: s[statTrees] - s[statComplete],
+		Leaves:          s[statLeaves],
+		Branches:        s[statBranches],
+		LogicalBytes:    s[statLogical],
+		PhysicalBytes:   s[statLeaves] * int64(f.blockSize+overhead),
+		SaplingBytes:    s[statSapling],
+		DedupRatio:      1,
+	}
+	if s[statLeaves] > 0 {
+		out.DedupRatio = float64(s[statTreeLeaves]) / float64(s[statLeaves])
+	}
+	return out
+}
+
+// countStats computes the counters from the tree records and branches.
+func (f *Forest) countStats(tx MetaTx) (statCounters, error) {
+	var s statCounters
+	leaves := make(map[crypto.Digest]bool)
+	branches := make(map[crypto.Digest]bool)
+	var visit func(d *crypto.Digest)
+	visit = func(d *crypto.Digest) {
+		if branches[*d] {
+			return
+		}
+		br := f.readBranchTx(tx, d)
+		if br == nil {
+			return
+		}
+		branches[*d] = true
+		if br.lIsLeaf() {
+			leaves[*br.left] = true
+		} else {
+			visit(br.left)
+		}
+		if br.rIsLeaf() {
+			leaves[*br.right] = true
+		} else {
+			visit(br.right)
+		}
+	}
+	err := f.eachTree(tx, func(t *Tree) error {
+		s.add(treeStats(t), 1)
+		if t.rootIsLeaf() {
+			leaves[*t.dig] = true
+		} else if t.leaves > 1 {
+			visit(t.dig)
+		}
+		return nil
+	})
+	s[statLeaves] = int64(len(leaves))
+	s[statBranches] = int64(len(branches))
+	return s, err
+}
+
+// rebuildStats replaces the counters with ones computed from the tree records
+// and branches.
+func (f *Forest) rebuildStats(tx MetaTx) error {
+	s, err := f.countStats(tx)
+	if err != nil {
+		return err
+	}
+	return f.setStatsTx(tx, s)
+}
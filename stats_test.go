@@ -0,0 +1,117 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func assertStatsConsistent(t *testing.T, f *Forest) {
+	f.meta.View(func(tx MetaTx) error {
+		s, err := f.countStats(tx)
+		assert.NoError(t, err)
+		assert.Equal(t, s, f.getStatsTx(tx))
+		return nil
+	})
+}
+
+func TestStats(t *testing.T) {
+	f := OpenMemory(crypto.RandomSymmetric())
+	assert.Equal(t, Stats{DedupRatio: 1}, f.Stats())
+
+	data := make([]byte, BlockSize*4)
+	rand.Read(data)
+	// b shares its first 2 leaves with a
+	a, err := f.BuildTree(bytes.NewReader(data[:BlockSize*2+10]))
+	if !assert.NoError(t, err) {
+		return
+	}
+	b, err := f.BuildTree(bytes.NewReader(data[:BlockSize*3+10]))
+	if !assert.NoError(t, err) {
+		return
+	}
+	small, err := f.BuildTree(bytes.NewReader(data[:100]))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assertStatsConsistent(t, f)
+
+	s := f.Stats()
+	assert.Equal(t, int64(3), s.Trees)
+	assert.Equal(t, int64(3), s.CompleteTrees)
+	assert.Equal(t, int64(6), s.Leaves)
+	assert.Equal(t, int64(a.Len()+b.Len()+small.Len()), s.LogicalBytes)
+	assert.Equal(t, 8.0/6.0, s.DedupRatio)
+
+	// a sapling with one of two leaves
+	src := OpenMemory(crypto.RandomSymmetric())
+	srcTr, err := src.BuildTree(bytes.NewReader(data[BlockSize : BlockSize*2+10]))
+	assert.NoError(t, err)
+	sp := f.New(srcTr.Digest(), srcTr.leaves)
+	vc, leaf, err := srcTr.GetLeaf(1)
+	assert.NoError(t, err)
+	assert.NoError(t, sp.AddLeaf(vc, leaf, 1))
+	assertStatsConsistent(t, f)
+	s = f.Stats()
+	assert.Equal(t, int64(1), s.IncompleteTrees)
+	assert.Equal(t, int64(BlockSize), s.SaplingBytes)
+
+	vc, leaf, err = srcTr.GetLeaf(0)
+	assert.NoError(t, err)
+	assert.NoError(t, sp.AddLeaf(vc, leaf, 0))
+	assertStatsConsistent(t, f)
+	s = f.Stats()
+	assert.Equal(t, int64(0), s.IncompleteTrees)
+	assert.Equal(t, int64(0), s.SaplingBytes)
+
+	assert.NoError(t, f.DeleteTree(b.Digest()))
+	assertStatsConsistent(t, f)
+	_, err = f.GC()
+	assert.NoError(t, err)
+	assertStatsConsistent(t, f)
+	assert.Equal(t, int64(3), f.Stats().Trees)
+}
+
+func TestStatsUnsharedSapling(t *testing.T) {
+	f := OpenMemory(crypto.RandomSymmetric())
+	src := OpenMemory(crypto.RandomSymmetric())
+	data := make([]byte, BlockSize*4+100)
+	rand.Read(data)
+	srcTr, err := src.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// each leaf is counted once when it is added, not when an uncle is
+	sp := f.New(srcTr.Digest(), srcTr.leaves)
+	for i, lIdx := range []int{1, 0, 4, 2, 3} {
+		vc, leaf, err := srcTr.GetLeaf(lIdx)
+		assert.NoError(t, err)
+		assert.NoError(t, sp.AddLeaf(vc, leaf, lIdx))
+		assertStatsConsistent(t, f)
+		assert.Equal(t, int64(i+1), f.Stats().Leaves)
+	}
+	s := f.Stats()
+	assert.Equal(t, int64(1), s.CompleteTrees)
+	assert.Equal(t, int64(5*(BlockSize+overhead)), s.PhysicalBytes)
+	assert.Equal(t, 1.0, s.DedupRatio)
+
+	// a single leaf sapling has no leaves until it is complete
+	small, err := src.BuildTree(bytes.NewReader(data[:100]))
+	assert.NoError(t, err)
+	sp = f.New(small.Digest(), 1)
+	assertStatsConsistent(t, f)
+	assert.Equal(t, int64(5), f.Stats().Leaves)
+	vc, leaf, err := small.GetLeaf(0)
+	assert.NoError(t, err)
+	assert.NoError(t, sp.AddLeaf(vc, leaf, 0))
+	assertStatsConsistent(t, f)
+	assert.Equal(t, int64(6), f.Stats().Leaves)
+
+	assert.NoError(t, f.DeleteTree(srcTr.Digest()))
+	assert.NoError(t, f.DeleteTree(small.Digest()))
+	assertStatsConsistent(t, f)
+	assert.Equal(t, Stats{DedupRatio: 1}, f.Stats())
+}
@@ -2,13 +2,16 @@ package merkle
 
 import (
 	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/serial"
+	"time"
 )
 
-// BlockSize is the size of each leaf. The encryption adds about 40 bytes. Most
-// disks have a physical sector size of 4096. The block size is designed to use
-// 2 sectors per leaf, a compromize between current effiency and future-
-// proofing. There's also 40 bytes extra (double the encryption overhead) to
-// ensure that it doesn't go over and require a 3rd sector.
+// BlockSize is the default size of each leaf. The encryption adds about 40
+// bytes. Most disks have a physical sector size of 4096. The block size is
+// designed to use 2 sectors per leaf, a compromize between current effiency and
+// future-proofing. There's also 40 bytes extra (double the encryption overhead)
+// to ensure that it doesn't go over and require a 3rd sector. A Forest can use
+// a different block size by setting it in the Options.
 const BlockSize = 8112
 
 // Tree is how a resource is stored. It represents the top level digest of a
@@ -21,6 +24,9 @@ type Tree struct {
 	pos            int64
 	complete       bool
 	leavesComplete []bool
+	expires        time.Time
+	namespace      string
+	meta           *TreeMeta
 }
 
 // Digest gives the Digest that identifies the tree. This can be used to request
@@ -30,15 +36,67 @@ func (t *Tree) Digest() *crypto.Digest { return t.dig }
 // Complete returns true if the tree has all it's leaves.
 func (t *Tree) Complete() bool { return t.complete }
 
-// New returns a new Tree
+// Expires returns when the tree will be removed from the Forest. It is zero if
+// the tree does not expire.
+func (t *Tree) Expires() time.Time { return t.expires }
+
+// Namespace returns the namespace the tree is counted against for quotas.
+func (t *Tree) Namespace() string { return t.namespace }
+
+// rootIsLeaf is true if the tree is a single leaf that is present.
+func (t *Tree) rootIsLeaf() bool { return t.leaves == 1 && t.complete }
+
+func (t *Tree) expired(now time.Time) bool {
+	return !t.expires.IsZero() && !now.Before(t.expires)
+}
+
+// New returns a new Tree. It returns nil if the Forest is read only.
 func (f *Forest) New(d *crypto.Digest, l uint32) *Tree {
+	t, _ := f.NewWithOptions(d, l, nil)
+	return t
+}
+
+// NewWithOptions returns a new Tree, leaves can be added to it with AddLeaf.
+// Space for all l leaves is reserved against the quotas when it is created.
+func (f *Forest) NewWithOptions(d *crypto.Digest, l uint32, opts *TreeOptions) (*Tree, error) {
+	if err := f.writable(); err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &TreeOptions{}
+	}
+	if opts.Meta != nil {
+		if err := opts.Meta.validate(); err != nil {
+			return nil, err
+		}
+	}
+	f.treeMux.RLock()
+	defer f.treeMux.RUnlock()
+	if err := f.checkSapling(d, l, opts.Namespace); err != nil {
+		return nil, err
+	}
 	t := &Tree{
 		leaves:         l,
 		dig:            d,
 		f:              f,
-		lastBlockLen:   BlockSize,
+		lastBlockLen:   uint16(f.blockSize),
 		leavesComplete: make([]bool, l),
+		expires:        opts.Expires,
+		namespace:      opts.Namespace,
+		meta:           f.stampMeta(opts.Meta, nil),
 	}
-	f.writeTree(t)
-	return t
+	if err := f.writeTree(t); err != nil {
+		return nil, err
+	}
+	f.touch(d)
+	return t, nil
+}
+
+// Times are saved as nanoseconds since the Unix epoch.
+func marshalTime(t time.Time, b []byte) {
+	serial.MarshalUint64(uint64(t.UnixNano()), b)
+}
+
+func unmarshalTime(b []byte) time.Time {
+	return time.Unix(0, int64(serial.UnmarshalUint64(b)))
 }
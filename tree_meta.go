@@ -0,0 +1,193 @@
+package merkle
+
+import (
+	"github.com/dist-ribut-us/errors"
+	"github.com/dist-ribut-us/serial"
+	"sort"
+	"time"
+)
+
+// TreeMeta is optional information about a tree. It is saved, encrypted, in
+// the tree record.
+type TreeMeta struct {
+	// Created is set when the meta data is first saved, if it is zero.
+	Created time.Time
+	// Modified is set each time the meta data is saved.
+	Modified    time.Time
+	Name        string
+	ContentType string
+	Labels      map[string]string
+}
+
+// ErrMetaTooLarge is returned if a string in a TreeMeta is longer than 65535
+// bytes or it has more than 65535 labels.
+const ErrMetaTooLarge = errors.String("Tree meta data is too large")
+
+func (m *TreeMeta) copy() *TreeMeta {
+	if m == nil {
+		return nil
+	}
+	out := *m
+	if m.Labels != nil {
+		out.Labels = make(map[string]string, len(m.Labels))
+		for k, v := range m.Labels {
+			out.Labels[k] = v
+		}
+	}
+	return &out
+}
+
+func (m *TreeMeta) validate() error {
+	if len(m.Name) > 65535 || len(m.ContentType) > 65535 || len(m.Labels) > 65535 {
+		return ErrMetaTooLarge
+	}
+	for k, v := range m.Labels {
+		if len(k) > 65535 || len(v) > 65535 {
+			return ErrMetaTooLarge
+		}
+	}
+	return nil
+}
+
+func (m *TreeMeta) size() int {
+	l := 16 + 2 + len(m.Name) + 2 + len(m.ContentType) + 2
+	for k, v := range m.Labels {
+		l += 4 + len(k) + len(v)
+	}
+	return l
+}
+
+// marshal writes the TreeMeta to b, which must be at least m.size() long. The
+// labels are sorted so the same TreeMeta always gives the same bytes.
+func (m *TreeMeta) marshal(b []byte) int {
+	marshalTime(m.Created, b)
+	marshalTime(m.Modified, b[8:])
+	off := 16
+	off += marshalString(m.Name, b[off:])
+	off += marshalString(m.ContentType, b[off:])
+	keys := make([]string, 0, len(m.Labels))
+	for k := range m.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	serial.MarshalUint16(uint16(len(keys)), b[off:])
+	off += 2
+	for _, k := range keys {
+		off += marshalString(k, b[off:])
+		off += marshalString(m.Labels[k], b[off:])
+	}
+	return off
+}
+
+// unmarshalTreeMeta returns the TreeMeta and the number of bytes read. If b is
+// too short, it returns nil.
+func unmarshalTreeMeta(b []byte) (*TreeMeta, int) {
+	if len(b) < 16 {
+		return nil, 0
+	}
+	m := &TreeMeta{
+		Created:  unmarshalTime(b),
+		Modified: unmarshalTime(b[8:]),
+	}
+	off := 16
+	var n int
+	if m.Name, n = unmarshalString(b[off:]); n == 0 {
+		return nil, 0
+	}
+	off += n
+	if m.ContentType, n = unmarshalString(b[off:]); n == 0 {
+		return nil, 0
+	}
+	off += n
+	if len(b) < off+2 {
+		return nil, 0
+	}
+	labels := int(serial.UnmarshalUint16(b[off:]))
+	off += 2
+	if labels > 0 {
+		m.Labels = make(map[string]string, labels)
+	}
+	for i := 0; i < labels; i++ {
+		var k, v string
+		if k, n = unmarshalString(b[off:]); n == 0 {
+			return nil, 0
+		}
+		off += n
+		if v, n = unmarshalString(b[off:]); n == 0 {
+			return nil, 0
+		}
+		off += n
+		m.Labels[k] = v
+	}
+	return m, off
+}
+
+func marshalString(s string, b []byte) int {
+	serial.MarshalUint16(uint16(len(s)), b)
+	return 2 + copy(b[2:], s)
+}
+
+// unmarshalString returns the string and the number of bytes read, which is 0
+// if b is too short.
+func unmarshalString(b []byte) (string, int) {
+	if len(b) < 2 {
+		return "", 0
+	}
+	l := int(serial.UnmarshalUint16(b))
+	if len(b) < 2+l {
+		return "", 0
+	}
+	return string(b[2 : 2+l]), 2 + l
+}
+
+// Meta returns a copy of the tree's meta data, or nil if it has none.
+func (t *Tree) Meta() *TreeMeta { return t.meta.copy() }
+
+// SetMeta replaces the tree's meta data. If Created is zero, it keeps the time
+// the meta data was first saved.
+func (t *Tree) SetMeta(m *TreeMeta) error {
+	f := t.f
+	if err := f.writable(); err != nil {
+		return err
+	}
+	if m != nil {
+		if err := m.validate(); err != nil {
+			return err
+		}
+	}
+	f.treeMux.RLock()
+	defer f.treeMux.RUnlock()
+	var saved *TreeMeta
+	err := f.meta.Update(func(tx MetaTx) error {
+		cur := f.getTreeTx(tx, t.dig)
+		if cur == nil {
+			return ErrTreeNotFound
+		}
+		cur.meta = f.stampMeta(m, cur.meta)
+		saved = cur.meta
+		return f.writeTreeTx(tx, cur)
+	})
+	if err == nil {
+		t.meta = saved
+	}
+	return err
+}
+
+// stampMeta returns a copy of m with the times set. Created is taken from old
+// if it is not set.
+func (f *Forest) stampMeta(m, old *TreeMeta) *TreeMeta {
+	if m == nil {
+		return nil
+	}
+	m = m.copy()
+	now := f.clock()
+	if m.Created.IsZero() {
+		if old != nil {
+			m.Created = old.Created
+		} else {
+			m.Created = now
+		}
+	}
+	m.Modified = now
+	return m
+}
@@ -0,0 +1,84 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTreeMeta(t *testing.T) {
+	clock := &testClock{now: time.Unix(1000000, 0)}
+	f, err := newForest(crypto.RandomSymmetric(), newMemMeta(), newMemStore(), &Options{
+		Clock: clock.Now,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	data := make([]byte, 1000)
+	rand.Read(data)
+	created := clock.Now()
+	tr, err := f.BuildTreeWithOptions(bytes.NewReader(data), &TreeOptions{
+		Namespace: "ns",
+		Meta: &TreeMeta{
+			Name:        "test.txt",
+			ContentType: "text/plain",
+			Labels: map[string]string{
+				"b": "2",
+				"a": "1",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	m := f.GetTree(tr.Digest()).Meta()
+	if assert.NotNil(t, m) {
+		assert.Equal(t, "test.txt", m.Name)
+		assert.Equal(t, "text/plain", m.ContentType)
+		assert.Equal(t, map[string]string{"a": "1", "b": "2"}, m.Labels)
+		assert.True(t, created.Equal(m.Created))
+		assert.True(t, created.Equal(m.Modified))
+	}
+	assert.Equal(t, "ns", f.GetTree(tr.Digest()).Namespace())
+
+	// Meta returns a copy
+	m.Labels["a"] = "changed"
+	assert.Equal(t, "1", tr.Meta().Labels["a"])
+
+	clock.Add(time.Hour)
+	assert.NoError(t, tr.SetMeta(&TreeMeta{Name: "renamed"}))
+	m = f.GetTree(tr.Digest()).Meta()
+	assert.Equal(t, "renamed", m.Name)
+	assert.Nil(t, m.Labels)
+	assert.True(t, created.Equal(m.Created))
+	assert.True(t, clock.Now().Equal(m.Modified))
+	out, err := f.GetTree(tr.Digest()).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+
+	// building the tree again without Meta keeps it
+	_, err = f.BuildTree(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, "renamed", f.GetTree(tr.Digest()).Meta().Name)
+
+	assert.NoError(t, tr.SetMeta(nil))
+	assert.Nil(t, f.GetTree(tr.Digest()).Meta())
+
+	// saplings keep their meta data as leaves are added
+	s, err := f.NewWithOptions(crypto.GetDigest([]byte("sapling")), 3, &TreeOptions{
+		Meta: &TreeMeta{Name: "sapling"},
+	})
+	assert.NoError(t, err)
+	s = f.GetTree(s.Digest())
+	assert.False(t, s.Complete())
+	assert.Equal(t, "sapling", s.Meta().Name)
+	assert.Equal(t, uint32(3), s.leaves)
+
+	assert.Equal(t, ErrMetaTooLarge, tr.SetMeta(&TreeMeta{Name: strings.Repeat("a", 65536)}))
+}
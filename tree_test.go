@@ -7,6 +7,7 @@ import (
 	"github.com/dist-ribut-us/crypto"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -102,7 +103,7 @@ func TestTree(t *testing.T) {
 		// Every file should be larger than the BlockSize because it should be a full
 		// block plus the MAC.
 		err = filepath.Walk(dirStr, func(path string, info os.FileInfo, err error) error {
-			if strings.HasSuffix(path, ".db") || path == dirStr {
+			if strings.HasSuffix(path, ".db") || strings.HasSuffix(path, layoutFile) || path == dirStr {
 				return nil
 			}
 			if info.IsDir() {
@@ -110,7 +111,7 @@ func TestTree(t *testing.T) {
 			}
 			// On windows I was getting strange files with size 0
 			if info.Size() > 0 && info.Size() < BlockSize {
-				t.Log(info.Name)
+				t.Log(info.Name())
 				return fmt.Errorf("Too Small; Expect: %d Got: %d", BlockSize, info.Size())
 			}
 			return nil
@@ -137,24 +138,8 @@ func TestTree(t *testing.T) {
 }
 
 func TestSapling(t *testing.T) {
-	fromDir := "fromDir"
-	os.RemoveAll(fromDir)
-	toDir := "toDir"
-	os.RemoveAll(toDir)
-
-	fromKey := crypto.RandomSymmetric()
-
-	fFrom, err := Open(fromDir, fromKey)
-	if !assert.NoError(t, err) {
-		return
-	}
-
-	toKey := crypto.RandomSymmetric()
-
-	fTo, err := Open(toDir, toKey)
-	if !assert.NoError(t, err) {
-		return
-	}
+	fFrom := OpenMemory(crypto.RandomSymmetric())
+	fTo := OpenMemory(crypto.RandomSymmetric())
 
 	data := make([]byte, (8*BlockSize)/3)
 	rand.Read(data)
@@ -194,8 +179,95 @@ func TestSapling(t *testing.T) {
 	assert.Equal(t, data, tOutData)
 
 	fFrom.Close()
-	assert.NoError(t, os.RemoveAll(fromDir))
-
 	fTo.Close()
-	assert.NoError(t, os.RemoveAll(toDir))
+}
+
+func TestSaplingStaleTree(t *testing.T) {
+	fFrom := OpenMemory(crypto.RandomSymmetric())
+	fTo := OpenMemory(crypto.RandomSymmetric())
+	data := make([]byte, BlockSize*2+10)
+	rand.Read(data)
+	tr, err := fFrom.BuildTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// leaves added and meta data set through other Trees are not lost
+	a := fTo.New(tr.Digest(), tr.leaves)
+	b := fTo.GetTree(tr.Digest())
+	assert.NoError(t, b.SetMeta(&TreeMeta{Name: "b"}))
+	for i := 0; i < int(tr.leaves); i++ {
+		vc, l, err := tr.GetLeaf(i)
+		assert.NoError(t, err)
+		if i%2 == 0 {
+			assert.NoError(t, a.AddLeaf(vc, l, i))
+		} else {
+			assert.NoError(t, b.AddLeaf(vc, l, i))
+		}
+	}
+	assert.True(t, a.Complete())
+	assert.False(t, b.Complete())
+
+	saved := fTo.GetTree(tr.Digest())
+	assert.True(t, saved.Complete())
+	assert.Equal(t, "b", saved.Meta().Name)
+	out, err := saved.ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+}
+
+func TestInlineTree(t *testing.T) {
+	dirStr := "TestInlineTree"
+	os.RemoveAll(dirStr)
+	key := crypto.RandomSymmetric()
+
+	f, err := Open(dirStr, key)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, size := range []int{1, 100, 1000, InlineSize} {
+		data := make([]byte, size)
+		rand.Read(data)
+		tr, err := f.BuildTree(bytes.NewReader(data))
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		tr = f.GetTree(tr.Digest())
+		out, err := tr.ReadAll()
+		assert.NoError(t, err)
+		assert.Equal(t, data, out)
+
+		out = make([]byte, size+10)
+		n, _ := tr.Read(out)
+		assert.Equal(t, size, n)
+		assert.Equal(t, data, out[:n])
+
+		vc, l, err := tr.GetLeaf(0)
+		assert.NoError(t, err)
+		assert.Equal(t, data, l)
+		assert.True(t, tr.ValidateLeaf(vc, l, 0))
+
+		// saplings get stored inline too
+		fTo := OpenMemory(crypto.RandomSymmetric())
+		tOut := fTo.New(tr.Digest(), 1)
+		tOut.AddLeaf(vc, l, 0)
+		out, err = tOut.ReadAll()
+		assert.NoError(t, err)
+		assert.Equal(t, data, out)
+		fTo.Close()
+	}
+
+	// only the Bolt DB and the layoutFile
+	files, err := ioutil.ReadDir(dirStr)
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	assert.Equal(t, 4096-overhead, inlineClass(InlineSize))
+	assert.Equal(t, 128-overhead, inlineClass(0))
+	assert.Equal(t, 256-overhead, inlineClass(100))
+
+	f.Close()
+	assert.NoError(t, os.RemoveAll(dirStr))
 }
@@ -0,0 +1,88 @@
+package merkle
+
+import (
+	"github.com/dist-ribut-us/crypto"
+)
+
+// TreeFilter selects the trees returned by Trees.
+type TreeFilter byte
+
+// Filters for Trees
+const (
+	AllTrees TreeFilter = iota
+	CompleteTrees
+	IncompleteTrees
+	PinnedTrees
+)
+
+// TreeIterator steps through the trees in a Forest. Call Next until it returns
+// false, then check Err. The digests are read when it is created, a tree that
+// is removed before it is reached is skipped.
+type TreeIterator struct {
+	f      *Forest
+	filter TreeFilter
+	ds     []*crypto.Digest
+	t      *Tree
+	err    error
+}
+
+// Trees returns an iterator over the trees in the Forest that match the
+// filter. Like GetTree, expired trees that are not pinned are skipped. Listing
+// trees does not change when they were last accessed.
+func (f *Forest) Trees(filter TreeFilter) *TreeIterator {
+	it := &TreeIterator{
+		f:      f,
+		filter: filter,
+	}
+	it.err = f.meta.View(func(tx MetaTx) error {
+		it.ds = f.treeDigests(tx)
+		return nil
+	})
+	return it
+}
+
+// Next moves to the next tree, it returns false when there are no more trees
+// or there was an error.
+func (it *TreeIterator) Next() bool {
+	it.t = nil
+	now := it.f.clock()
+	for it.err == nil && len(it.ds) > 0 {
+		d := it.ds[0]
+		it.ds = it.ds[1:]
+		var t *Tree
+		it.err = it.f.meta.View(func(tx MetaTx) error {
+			t = it.f.getTreeTx(tx, d)
+			if t == nil {
+				return nil
+			}
+			pinned := it.f.getPinTx(tx, d) > 0
+			if (!pinned && t.expired(now)) || !it.match(t, pinned) {
+				t = nil
+			}
+			return nil
+		})
+		if t != nil {
+			it.t = t
+			return true
+		}
+	}
+	return false
+}
+
+func (it *TreeIterator) match(t *Tree, pinned bool) bool {
+	switch it.filter {
+	case CompleteTrees:
+		return t.complete
+	case IncompleteTrees:
+		return !t.complete
+	case PinnedTrees:
+		return pinned
+	}
+	return true
+}
+
+// Tree returns the current tree.
+func (it *TreeIterator) Tree() *Tree { return it.t }
+
+// Err returns the error, if any, that stopped the iterator.
+func (it *TreeIterator) Err() error { return it.err }
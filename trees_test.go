@@ -0,0 +1,70 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func collectTrees(t *testing.T, f *Forest, filter TreeFilter) map[crypto.Digest]*Tree {
+	trees := make(map[crypto.Digest]*Tree)
+	it := f.Trees(filter)
+	for it.Next() {
+		trees[*it.Tree().Digest()] = it.Tree()
+	}
+	assert.NoError(t, it.Err())
+	return trees
+}
+
+func TestTrees(t *testing.T) {
+	f := OpenMemory(crypto.RandomSymmetric())
+	assert.Len(t, collectTrees(t, f, AllTrees), 0)
+
+	var complete []*Tree
+	for i := 0; i < 3; i++ {
+		data := make([]byte, 1000*(i+1))
+		rand.Read(data)
+		tr, err := f.BuildTreeWithOptions(bytes.NewReader(data), &TreeOptions{
+			Meta: &TreeMeta{Name: "tree"},
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		complete = append(complete, tr)
+	}
+	s := f.New(crypto.GetDigest([]byte("sapling")), 5)
+	assert.NoError(t, f.Pin(complete[1].Digest()))
+
+	all := collectTrees(t, f, AllTrees)
+	assert.Len(t, all, 4)
+	for i, tr := range complete {
+		got := all[*tr.Digest()]
+		if assert.NotNil(t, got) {
+			assert.Equal(t, 1000*(i+1), got.Len())
+			assert.True(t, got.Complete())
+			assert.Equal(t, "tree", got.Meta().Name)
+		}
+	}
+
+	assert.Len(t, collectTrees(t, f, CompleteTrees), 3)
+	incomplete := collectTrees(t, f, IncompleteTrees)
+	if assert.Len(t, incomplete, 1) {
+		assert.NotNil(t, incomplete[*s.Digest()])
+	}
+	pinned := collectTrees(t, f, PinnedTrees)
+	if assert.Len(t, pinned, 1) {
+		assert.NotNil(t, pinned[*complete[1].Digest()])
+	}
+
+	// a tree removed while iterating is skipped
+	it := f.Trees(AllTrees)
+	assert.NoError(t, f.DeleteTree(complete[0].Digest()))
+	n := 0
+	for it.Next() {
+		assert.NotEqual(t, complete[0].Digest(), it.Tree().Digest())
+		n++
+	}
+	assert.Equal(t, 3, n)
+}
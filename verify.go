@@ -0,0 +1,300 @@
+package merkle
+
+import (
+	"context"
+	"github.com/dist-ribut-us/crypto"
+)
+
+// ProblemKind describes what is wrong with a record found by Verify.
+type ProblemKind byte
+
+// Kinds of problems found by Verify
+const (
+	// BadTreeRecord is a tree record that can't be decrypted or decoded.
+	BadTreeRecord ProblemKind = iota + 1
+	// MissingBranch is a branch referenced by a tree or branch that is not in
+	// the Forest.
+	MissingBranch
+	// MissingLeaf is a leaf referenced by a branch or marked complete in a
+	// tree that is not in the Forest.
+	MissingLeaf
+	// DecryptFailed is a leaf or branch that could not be decrypted, or a leaf
+	// the LeafStore could only read part of.
+	DecryptFailed
+	// DigestMismatch is a leaf or branch that does not hash to its digest.
+	DigestMismatch
+	// ReadFailed is a leaf that the LeafStore returned an error for.
+	ReadFailed
+)
+
+var problemKinds = map[ProblemKind]string{
+	BadTreeRecord:  "bad tree record",
+	MissingBranch:  "missing branch",
+	MissingLeaf:    "missing leaf",
+	DecryptFailed:  "decryption failed",
+	DigestMismatch: "digest mismatch",
+	ReadFailed:     "read failed",
+}
+
+func (k ProblemKind) String() string { return problemKinds[k] }
+
+// Problem is a single problem found by Verify. Start and End are the range of
+// leaves in the tree below Node, so they are the leaves that can't be read. For
+// a tree record whose key can't be decrypted, Tree and Node are nil.
+type Problem struct {
+	Kind       ProblemKind
+	Tree       *crypto.Digest
+	Node       *crypto.Digest
+	Start, End uint32
+	Err        error
+}
+
+// VerifyReport is the result of Verify. A leaf or branch shared by several
+// trees is only checked once, but a problem with it is reported for each tree.
+type VerifyReport struct {
+	Trees    int
+	Branches int
+	Leaves   int
+	Problems []Problem
+}
+
+// OK returns true if no problems were found.
+func (r *VerifyReport) OK() bool { return len(r.Problems) == 0 }
+
+// corrupt returns true if any of the problems are something other than a
+// leaf the LeafStore failed to read.
+func (r *VerifyReport) corrupt() bool {
+	for _, p := range r.Problems {
+		if p.Kind != ReadFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// readErr returns the error of the first leaf the LeafStore failed to read.
+func (r *VerifyReport) readErr() error {
+	for _, p := range r.Problems {
+		if p.Kind == ReadFailed {
+			return p.Err
+		}
+	}
+	return nil
+}
+
+// verifyLeaf is a leaf to check after the branches of a tree are walked.
+type verifyLeaf struct {
+	dig        *crypto.Digest
+	ln         int
+	start, end uint32
+}
+
+// verifier holds the state of a Verify.
+type verifier struct {
+	f      *Forest
+	report *VerifyReport
+	// checked holds the result of each leaf and branch already checked, nil
+	// if it was fine.
+	checked map[crypto.Digest]*Problem
+	// pace, if it is set, is called with the number of bytes read after the
+	// branches of a tree and after each leaf so reads can be rate limited.
+	pace func(ctx context.Context, n int) error
+	// read is the bytes read since pace was last called.
+	read int
+}
+
+// Verify checks every tree record, branch and leaf in the Forest. Each branch
+// and leaf is decrypted and hashed and compared to its digest. Only the leaves
+// that are complete are checked in a sapling. Caches are not used. If ctx is
+// cancelled, the report so far is returned with the error.
+func (f *Forest) Verify(ctx context.Context) (*VerifyReport, error) {
+	f.treeMux.RLock()
+	defer f.treeMux.RUnlock()
+	return f.verify(ctx)
+}
+
+// verify is Verify without the lock.
+func (f *Forest) verify(ctx context.Context) (*VerifyReport, error) {
+	v := newVerifier(f)
+	var ds []*crypto.Digest
+	var bad [][]byte
+	err := f.meta.View(func(tx MetaTx) error {
+		ds, bad = f.treeKeys(tx)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for range bad {
+		v.report.Problems = append(v.report.Problems, Problem{Kind: BadTreeRecord})
+	}
+	for _, d := range ds {
+		if err = ctx.Err(); err != nil {
+			return v.report, err
+		}
+		if err = v.tree(ctx, d); err != nil {
+			return v.report, err
+		}
+	}
+	return v.report, nil
+}
+
+func newVerifier(f *Forest) *verifier {
+	return &verifier{
+		f:       f,
+		report:  &VerifyReport{},
+		checked: make(map[crypto.Digest]*Problem),
+	}
+}
+
+// tree checks one tree. The tree record and branches are checked in a single
+// transaction, then the leaves are checked outside of it.
+func (v *verifier) tree(ctx context.Context, d *crypto.Digest) error {
+	var t *Tree
+	var leaves []verifyLeaf
+	v.f.meta.View(func(tx MetaTx) error {
+		t = v.f.getTreeTx(tx, d)
+		if t == nil {
+			if v.f.getSealed(tx.Bucket(treeBkt), d.Slice()) != nil {
+				v.report.Problems = append(v.report.Problems, Problem{
+					Kind: BadTreeRecord,
+					Tree: d,
+					Node: d,
+				})
+			}
+			return nil
+		}
+		leaves = v.branches(tx, t, d, 0, t.leaves, t.leaves == 1, nil)
+		return nil
+	})
+	if t == nil {
+		return nil
+	}
+	v.report.Trees++
+	if err := v.paceRead(ctx); err != nil {
+		return err
+	}
+	for _, l := range leaves {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if p := v.leaf(l); p != nil {
+			p.Tree, p.Start, p.End = t.dig, l.start, l.end
+			v.report.Problems = append(v.report.Problems, *p)
+		}
+		if err := v.paceRead(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// paceRead passes the bytes read since the last call to pace. It is not called
+// inside a transaction so it doesn't hold one open while it waits.
+func (v *verifier) paceRead(ctx context.Context) error {
+	n := v.read
+	v.read = 0
+	if v.pace == nil || n == 0 {
+		return nil
+	}
+	return v.pace(ctx, n)
+}
+
+// branches checks the branches below d, which covers leaves start to end, and
+// appends the leaves that should be checked.
+func (v *verifier) branches(tx MetaTx, t *Tree, d *crypto.Digest, start, end uint32, isLeaf bool, leaves []verifyLeaf) []verifyLeaf {
+	if !t.complete {
+		present := false
+		for i := start; i < end && !present; i++ {
+			present = t.leavesComplete[i]
+		}
+		if !present {
+			return leaves
+		}
+	}
+	if isLeaf {
+		ln := v.f.blockSize
+		if start == t.leaves-1 {
+			ln = int(t.lastBlockLen)
+		}
+		return append(leaves, verifyLeaf{
+			dig:   d,
+			ln:    ln,
+			start: start,
+			end:   end,
+		})
+	}
+	p, ok := v.checked[*d]
+	var br *branch
+	if !ok {
+		p, br = v.branch(tx, d)
+		v.checked[*d] = p
+	} else if p == nil {
+		br = v.f.readBranchTx(tx, d)
+	}
+	if p != nil {
+		p := *p
+		p.Tree, p.Start, p.End = t.dig, start, end
+		v.report.Problems = append(v.report.Problems, p)
+		return leaves
+	}
+	mid := (start + end) / 2
+	leaves = v.branches(tx, t, br.left, start, mid, br.lIsLeaf(), leaves)
+	return v.branches(tx, t, br.right, mid, end, br.rIsLeaf(), leaves)
+}
+
+func (v *verifier) branch(tx MetaTx, d *crypto.Digest) (*Problem, *branch) {
+	v.report.Branches++
+	s := v.f.getSealed(tx.Bucket(branchBkt), d.Slice())
+	if s == nil {
+		return &Problem{Kind: MissingBranch, Node: d}, nil
+	}
+	v.read += len(s)
+	s, err := v.f.open(s)
+	if err != nil {
+		return &Problem{Kind: DecryptFailed, Node: d, Err: err}, nil
+	}
+	br := unmarshalBranch(s)
+	if br == nil || !br.dig.Equal(d) {
+		return &Problem{Kind: DigestMismatch, Node: d}, nil
+	}
+	return nil, br
+}
+
+// leaf checks a leaf, reading it from the inline bucket or the LeafStore.
+func (v *verifier) leaf(l verifyLeaf) *Problem {
+	if p, ok := v.checked[*l.dig]; ok {
+		if p == nil {
+			return nil
+		}
+		cp := *p
+		return &cp
+	}
+	v.report.Leaves++
+	p := v.checkLeaf(l)
+	v.checked[*l.dig] = p
+	if p == nil {
+		return nil
+	}
+	cp := *p
+	return &cp
+}
+
+func (v *verifier) checkLeaf(l verifyLeaf) *Problem {
+	b, err := v.f.getLeaf(l.dig)
+	if err == ErrLeafNotFound {
+		return &Problem{Kind: MissingLeaf, Node: l.dig}
+	} else if err == ErrCorrupt {
+		return &Problem{Kind: DecryptFailed, Node: l.dig, Err: err}
+	} else if err != nil {
+		return &Problem{Kind: ReadFailed, Node: l.dig, Err: err}
+	}
+	v.read += len(b)
+	if b, err = v.f.open(b); err != nil {
+		return &Problem{Kind: DecryptFailed, Node: l.dig, Err: err}
+	}
+	if len(b) < l.ln || !crypto.GetDigest(b[:l.ln]).Equal(l.dig) {
+		return &Problem{Kind: DigestMismatch, Node: l.dig}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package merkle
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// corruptForest builds a Forest with a tree for each kind of problem and
+// returns the trees in the order: good, missing leaf, bad leaf, garbage leaf,
+// missing branch, bad tree record.
+func corruptForest(t *testing.T) (*Forest, []*Tree, [][]byte) {
+	f := OpenMemory(crypto.RandomSymmetric())
+	store := f.leaves.(*memStore)
+	var trees []*Tree
+	var data [][]byte
+	for i := 0; i < 6; i++ {
+		d := make([]byte, BlockSize*3+10)
+		rand.Read(d)
+		tr, err := f.BuildTree(bytes.NewReader(d))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		trees = append(trees, tr)
+		data = append(data, d)
+	}
+	leafKey := func(tr *Tree, idx int) string {
+		vc, l, err := tr.GetLeaf(idx)
+		assert.NoError(t, err)
+		assert.NotNil(t, vc)
+		return string(f.sealDigest(crypto.GetDigest(l)))
+	}
+
+	delete(store.leaves, leafKey(trees[1], 1))
+	store.leaves[leafKey(trees[2], 2)] = f.key().Seal(make([]byte, BlockSize), nil)
+	store.leaves[leafKey(trees[3], 0)] = []byte("garbage")
+	f.meta.Update(func(tx MetaTx) error {
+		br := f.readBranchTx(tx, trees[4].Digest())
+		tx.Bucket(branchBkt).Delete(f.sealDigest(br.right))
+		tx.Bucket(treeBkt).Put(f.sealDigest(trees[5].Digest()), []byte("garbage"))
+		return nil
+	})
+	f.leafCache.purge()
+	f.branchCache.purge()
+	return f, trees, data
+}
+
+func TestVerify(t *testing.T) {
+	f, trees, _ := corruptForest(t)
+
+	r, err := f.Verify(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, r.OK())
+	assert.Equal(t, 5, r.Trees)
+
+	kinds := make(map[crypto.Digest]Problem)
+	for _, p := range r.Problems {
+		kinds[*p.Tree] = p
+	}
+	assert.Len(t, kinds, 5)
+	_, ok := kinds[*trees[0].Digest()]
+	assert.False(t, ok)
+
+	p := kinds[*trees[1].Digest()]
+	assert.Equal(t, MissingLeaf, p.Kind)
+	assert.Equal(t, uint32(1), p.Start)
+	assert.Equal(t, uint32(2), p.End)
+	assert.Equal(t, DigestMismatch, kinds[*trees[2].Digest()].Kind)
+	assert.Equal(t, DecryptFailed, kinds[*trees[3].Digest()].Kind)
+	p = kinds[*trees[4].Digest()]
+	assert.Equal(t, MissingBranch, p.Kind)
+	assert.Equal(t, uint32(2), p.Start)
+	assert.Equal(t, uint32(4), p.End)
+	assert.Equal(t, BadTreeRecord, kinds[*trees[5].Digest()].Kind)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = f.Verify(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	good := OpenMemory(crypto.RandomSymmetric())
+	_, err = good.BuildTree(bytes.NewReader(make([]byte, 10)))
+	assert.NoError(t, err)
+	r, err = good.Verify(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, r.OK())
+	assert.Equal(t, 1, r.Leaves)
+}